@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+const envPrefix = "etchosts"
+
+// version is set at build time
+var version = "dev"
+
+const (
+	cmdRun     = "run"
+	cmdSync    = "sync"
+	cmdPrint   = "print"
+	cmdDiff    = "diff"
+	cmdClean   = "clean"
+	cmdVersion = "version"
+)
+
+var commands = []struct{ name, desc string }{
+	{cmdRun, "keep the hosts file in sync with running containers (default)"},
+	{cmdSync, "update the hosts file once and exit"},
+	{cmdPrint, "print the resulting hosts file and exit"},
+	{cmdDiff, "print a diff between the current and the resulting hosts file and exit"},
+	{cmdClean, "remove all managed entries from the hosts file (optionally given as argument) and exit; does not need docker"},
+	{cmdVersion, "print the version and exit"},
+}
+
+// parseConfig reads the configuration from the environment and then from the command-line, which takes precedence.
+// Flags are accepted both before and after the command.
+func parseConfig(args []string, output io.Writer) (ConfigSpec, string, error) {
+	var config ConfigSpec
+
+	if err := envconfig.Process(envPrefix, &config); err != nil {
+		return config, "", fmt.Errorf("could not parse settings from env: %s", err)
+	}
+
+	fs := newFlagSet(&config, output)
+	if err := fs.Parse(args); err != nil {
+		return config, "", err
+	}
+
+	command := cmdRun
+	if fs.NArg() > 0 {
+		command = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return config, "", err
+		}
+	}
+	// clean may be given the hosts file to clean directly, e.g. after a crash
+	if command == cmdClean && fs.NArg() == 1 {
+		config.EtcHostsPath = fs.Arg(0)
+	} else if fs.NArg() > 0 {
+		return config, "", fmt.Errorf("unexpected arguments: %s", fs.Args())
+	}
+
+	switch command {
+	case cmdRun, cmdClean, cmdVersion:
+	case cmdSync:
+		config.Oneshot = oneshotWrite
+	case cmdPrint:
+		config.Oneshot = oneshotPrint
+	case cmdDiff:
+		config.Oneshot = oneshotDiff
+	default:
+		return config, "", fmt.Errorf("unknown command %s", command)
+	}
+
+	return config, command, nil
+}
+
+// newFlagSet creates a flag for each ConfigSpec field, using the current field values as defaults
+func newFlagSet(config *ConfigSpec, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("docker-etchosts", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	spec := reflect.ValueOf(config).Elem()
+	for i := 0; i < spec.NumField(); i++ {
+		field := spec.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		name := configKey(field)
+		usage := fmt.Sprintf("%s (env %s_%s)", field.Tag.Get("desc"), strings.ToUpper(envPrefix), strings.ToUpper(name))
+		fs.Var(fieldValue{spec.Field(i)}, strings.ReplaceAll(name, "_", "-"), usage)
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(output, "Usage: docker-etchosts [flags] [command] [flags] [hosts file (clean only)]\n\nCommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(output, "  %-10s%s\n", cmd.name, cmd.desc)
+		}
+		fmt.Fprintf(output, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+var splitWordsRegexp = regexp.MustCompile("([^A-Z]+|[A-Z][^A-Z]+|[A-Z]+)")
+
+// configKey returns the lowercase name envconfig uses for a field (without prefix)
+func configKey(field reflect.StructField) string {
+	if key := field.Tag.Get("envconfig"); key != "" {
+		return strings.ToLower(key)
+	}
+	if field.Tag.Get("split_words") == "true" {
+		return strings.ToLower(strings.Join(splitWordsRegexp.FindAllString(field.Name, -1), "_"))
+	}
+	return strings.ToLower(field.Name)
+}
+
+// fieldValue exposes a ConfigSpec field as a flag.Value, following envconfig's parsing rules for the types we use
+type fieldValue struct {
+	v reflect.Value
+}
+
+func (f fieldValue) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	switch val := f.v.Interface().(type) {
+	case []string:
+		return strings.Join(val, ",")
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func (f fieldValue) Set(s string) error {
+	switch f.v.Interface().(type) {
+	case string:
+		f.v.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(d))
+	case []string:
+		var vals []string
+		if s != "" {
+			vals = strings.Split(s, ",")
+		}
+		f.v.Set(reflect.ValueOf(vals))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.v.Type())
+	}
+	return nil
+}
+
+// IsBoolFlag allows boolean flags to be passed without value
+func (f fieldValue) IsBoolFlag() bool {
+	return f.v.IsValid() && f.v.Kind() == reflect.Bool
+}
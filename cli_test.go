@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseConfig(t *testing.T) {
+	os.Setenv("ETCHOSTS_LOG_LEVEL", "info")
+	os.Setenv("ETCHOSTS_ETC_HOSTS_PATH", "/tmp/hosts")
+	defer os.Unsetenv("ETCHOSTS_LOG_LEVEL")
+	defer os.Unsetenv("ETCHOSTS_ETC_HOSTS_PATH")
+
+	tests := []struct {
+		name        string
+		args        []string
+		wantCommand string
+		check       func(ConfigSpec) bool
+		wantErr     bool
+	}{
+		{"env and defaults", nil, cmdRun, func(c ConfigSpec) bool {
+			return c.LogLevel == "info" && c.EtcHostsPath == "/tmp/hosts" && c.IPFamily == "ipv4" && c.ResyncInterval == 5*time.Minute
+		}, false},
+		{"flags override env", []string{"--log-level", "debug"}, cmdRun, func(c ConfigSpec) bool {
+			return c.LogLevel == "debug" && c.EtcHostsPath == "/tmp/hosts"
+		}, false},
+		{"flags after command", []string{"print", "--ip-family=both", "--link-local-ipv6", "--debounce-interval=1s"}, cmdPrint, func(c ConfigSpec) bool {
+			return c.Oneshot == oneshotPrint && c.IPFamily == "both" && c.LinkLocalIPv6 && c.DebounceInterval == time.Second
+		}, false},
+		{"flags before command", []string{"--etc-hosts-path", "/other/hosts", "sync"}, cmdSync, func(c ConfigSpec) bool {
+			return c.Oneshot == oneshotWrite && c.EtcHostsPath == "/other/hosts"
+		}, false},
+		{"diff command", []string{"diff"}, cmdDiff, func(c ConfigSpec) bool { return c.Oneshot == oneshotDiff }, false},
+		{"clean command", []string{"clean"}, cmdClean, func(c ConfigSpec) bool { return c.EtcHostsPath == "/tmp/hosts" && c.Oneshot == "" }, false},
+		{"clean command with path", []string{"clean", "/other/hosts"}, cmdClean, func(c ConfigSpec) bool { return c.EtcHostsPath == "/other/hosts" }, false},
+		{"clean command with too many paths", []string{"clean", "/other/hosts", "/more/hosts"}, "", nil, true},
+		{"version command", []string{"version"}, cmdVersion, func(c ConfigSpec) bool { return true }, false},
+		{"unknown command", []string{"bogus"}, "", nil, true},
+		{"unknown flag", []string{"--bogus"}, "", nil, true},
+		{"invalid flag value", []string{"--resync-interval", "often"}, "", nil, true},
+		{"extra arguments", []string{"run", "something"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, command, err := parseConfig(tt.args, ioutil.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if command != tt.wantCommand {
+				t.Errorf("parseConfig() command = %s, want %s", command, tt.wantCommand)
+			}
+			if !tt.check(got) {
+				t.Errorf("parseConfig() unexpected config: %+v", got)
+			}
+		})
+	}
+}
+
+func Test_newFlagSet_coversConfigSpec(t *testing.T) {
+	fs := newFlagSet(&ConfigSpec{}, ioutil.Discard)
+	spec := reflect.TypeOf(ConfigSpec{})
+	for i := 0; i < spec.NumField(); i++ {
+		field := spec.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.ReplaceAll(configKey(field), "_", "-")
+		if fs.Lookup(name) == nil {
+			t.Errorf("no flag for %s", field.Name)
+		}
+		if field.Tag.Get("desc") == "" {
+			t.Errorf("no description for %s", field.Name)
+		}
+	}
+}
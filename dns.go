@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxUDPSize is the maximum DNS message size over UDP without EDNS
+const maxUDPSize = 512
+
+// dnsServer answers A, AAAA and PTR queries for the published entries, as an alternative to the hosts file
+type dnsServer struct {
+	ttl uint32
+
+	mu    sync.RWMutex
+	addrs map[string][]net.IP // fully qualified lowercase name to addresses
+	ptrs  map[string]string   // fully qualified reverse name to canonical name
+}
+
+func newDNSServer(ttl time.Duration) *dnsServer {
+	return &dnsServer{
+		ttl:   uint32(ttl / time.Second),
+		addrs: make(map[string][]net.IP),
+		ptrs:  make(map[string]string),
+	}
+}
+
+// update replaces all records with the given entries
+func (d *dnsServer) update(ipsToNames ipsToNamesMap) {
+	addrs := make(map[string][]net.IP)
+	ptrs := make(map[string]string)
+
+	for ipStr, names := range ipsToNames {
+		ip := net.ParseIP(ipStr)
+		if ip == nil || len(names) == 0 {
+			continue
+		}
+		for _, name := range names {
+			fqdn := toFQDN(name)
+			addrs[fqdn] = append(addrs[fqdn], ip)
+		}
+		ptrs[reverseName(ip)] = toFQDN(names[0])
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addrs, d.ptrs = addrs, ptrs
+}
+
+// serve answers queries on the given connection until it's closed
+func (d *dnsServer) serve(conn net.PacketConn) error {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp, err := d.handle(buf[:n])
+		if err != nil {
+			log.Debugf("dropping DNS query from %s: %s", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			log.Warnf("error answering DNS query from %s: %s", addr, err)
+		}
+	}
+}
+
+// handle returns the response to a single DNS query
+func (d *dnsServer) handle(req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse query: %s", err)
+	}
+	if header.Response {
+		return nil, fmt.Errorf("not a query")
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse question: %s", err)
+	}
+
+	respHeader := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+	if header.OpCode != 0 {
+		respHeader.RCode = dnsmessage.RCodeNotImplemented
+		return d.respond(respHeader, question, nil)
+	}
+
+	answers, found := d.lookup(question)
+	if !found {
+		respHeader.RCode = dnsmessage.RCodeNameError
+	}
+	return d.respond(respHeader, question, answers)
+}
+
+// lookup returns the answers to a question and whether the name is known at all
+func (d *dnsServer) lookup(q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	name := strings.ToLower(q.Name.String())
+	rrHeader := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: d.ttl}
+
+	if ptr, ok := d.ptrs[name]; ok {
+		if q.Type != dnsmessage.TypePTR {
+			return nil, true
+		}
+		ptrName, err := dnsmessage.NewName(ptr)
+		if err != nil {
+			return nil, true
+		}
+		return []dnsmessage.Resource{{Header: rrHeader, Body: &dnsmessage.PTRResource{PTR: ptrName}}}, true
+	}
+
+	addrs, ok := d.lookupAddrs(name)
+	if !ok {
+		return nil, false
+	}
+
+	var answers []dnsmessage.Resource
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			body := &dnsmessage.AResource{}
+			copy(body.A[:], ip4)
+			answers = append(answers, dnsmessage.Resource{Header: rrHeader, Body: body})
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			body := &dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip.To16())
+			answers = append(answers, dnsmessage.Resource{Header: rrHeader, Body: body})
+		}
+	}
+	return answers, true
+}
+
+// lookupAddrs returns the addresses for a name, falling back to the closest matching wildcard name (*.PARENT) for
+// any of its parents. Must be called with the lock held.
+func (d *dnsServer) lookupAddrs(name string) ([]net.IP, bool) {
+	if addrs, ok := d.addrs[name]; ok {
+		return addrs, true
+	}
+	for parent := name; strings.Contains(parent, "."); {
+		parent = parent[strings.Index(parent, ".")+1:]
+		if parent == "" {
+			break
+		}
+		if addrs, ok := d.addrs[wildcardPrefix+parent]; ok {
+			return addrs, true
+		}
+	}
+	return nil, false
+}
+
+func (d *dnsServer) respond(header dnsmessage.Header, question dnsmessage.Question, answers []dnsmessage.Resource) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header:    header,
+		Questions: []dnsmessage.Question{question},
+		Answers:   answers,
+	}
+	resp, err := msg.Pack()
+	if err != nil || len(resp) <= maxUDPSize {
+		return resp, err
+	}
+
+	// we don't support TCP, but at least let the client know the answer is incomplete
+	msg.Header.Truncated = true
+	msg.Answers = nil
+	return msg.Pack()
+}
+
+func toFQDN(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name for an IP
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	ip16 := ip.To16()
+	var b strings.Builder
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip16[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
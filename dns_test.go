@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testDNSQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+// answerStrings returns a readable representation of A, AAAA and PTR answers
+func answerStrings(answers []dnsmessage.Resource) []string {
+	var got []string
+	for _, answer := range answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			got = append(got, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			got = append(got, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.PTRResource:
+			got = append(got, body.PTR.String())
+		}
+	}
+	return got
+}
+
+func Test_dnsServer_handle(t *testing.T) {
+	dns := newDNSServer(10 * time.Second)
+	dns.update(ipsToNamesMap{
+		"1.2.3.4": {"service1", "somealias.test"},
+		"fd00::6": {"service6"},
+		"6.7.8.9": {"service6"},
+		"7.8.9.0": {"app.test", "*.app.test"},
+	})
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     dnsmessage.Type
+		wantRCode dnsmessage.RCode
+		want      []string
+	}{
+		{"A", "service1.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"1.2.3.4"}},
+		{"A for alias", "somealias.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"1.2.3.4"}},
+		{"A case-insensitive", "SERVICE1.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"1.2.3.4"}},
+		{"AAAA", "service6.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd00::6"}},
+		{"A for dual-stack", "service6.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"6.7.8.9"}},
+		{"AAAA without IPv6", "service1.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil},
+		{"unknown name", "unknown.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"PTR", "4.3.2.1.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"service1."}},
+		{"PTR IPv6", "6.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"service6."}},
+		{"wildcard base name", "app.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"7.8.9.0"}},
+		{"wildcard subdomain", "tenant1.app.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"7.8.9.0"}},
+		{"wildcard nested subdomain", "a.tenant1.app.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"7.8.9.0"}},
+		{"wildcard not matching parent", "test.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"unknown PTR", "1.1.1.1.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := dns.handle(testDNSQuery(t, tt.qname, tt.qtype))
+			if err != nil {
+				t.Fatalf("dnsServer.handle() error = %v", err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.ID != 42 || !msg.Header.Response {
+				t.Errorf("dnsServer.handle() unexpected header %+v", msg.Header)
+			}
+			if msg.Header.RCode != tt.wantRCode {
+				t.Errorf("dnsServer.handle() rcode = %v, want %v", msg.Header.RCode, tt.wantRCode)
+			}
+			if got := answerStrings(msg.Answers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dnsServer.handle() answers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dnsServer_serve(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("could not listen on UDP: %s", err)
+	}
+	defer conn.Close()
+
+	dns := newDNSServer(10 * time.Second)
+	dns.update(ipsToNamesMap{"1.2.3.4": {"service1"}})
+	go dns.serve(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write(testDNSQuery(t, "service1.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxUDPSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if got := answerStrings(msg.Answers); !reflect.DeepEqual(got, []string{"1.2.3.4"}) {
+		t.Errorf("dnsServer.serve() answers = %v", got)
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"regexp"
+	"net"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
 
 	"docker.io/go-docker/api/types"
 	"docker.io/go-docker/api/types/events"
 	"docker.io/go-docker/api/types/filters"
+	"docker.io/go-docker/api/types/network"
 	"github.com/cenkalti/backoff"
 	log "github.com/sirupsen/logrus"
 )
@@ -26,147 +30,703 @@ type dockerClientPinger interface {
 	Ping(context.Context) (types.Ping, error)
 }
 
-const dockerLabel string = "net.costela.docker-etchosts.extra_hosts";
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeNumberLabel  = "com.docker.compose.container-number"
+)
+
+// containerState holds the entries generated for a running container, along with the infos needed to resolve
+// conflicts with other containers
+type containerState struct {
+	name       string
+	created    time.Time
+	ipsToNames ipsToNamesMap
+}
+
+// containerStates holds the state of each running container, keyed by container ID
+type containerStates map[string]containerState
 
-func getAllIPsToNames(client dockerClienter) (ipsToNamesMap, error) {
+func getAllContainerStates(client dockerClienter, config ConfigSpec) (containerStates, error) {
 	containers, err := client.ContainerList(context.Background(), types.ContainerListOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	allIPsToNames := make(ipsToNamesMap)
+	states := make(containerStates, len(containers))
 
 	for _, container := range containers {
-		ipsToNames, err := getIPsToNames(client, container.ID)
+		state, err := getContainerState(client, container, config)
 		if err != nil {
 			return nil, err
 		}
+		states[container.ID] = state
+	}
+	return states, nil
+}
 
-		for ip, names := range ipsToNames {
-			if _, ok := allIPsToNames[ip]; !ok {
-				allIPsToNames[ip] = names
-			} else {
-				allIPsToNames[ip] = append(allIPsToNames[ip], names...)
+func getAllIPsToNames(client dockerClienter, config ConfigSpec) (ipsToNamesMap, error) {
+	states, err := getAllContainerStates(client, config)
+	if err != nil {
+		return nil, err
+	}
+	return states.ipsToNames(config), nil
+}
+
+// sortedIDs returns the container IDs in a stable order
+func (s containerStates) sortedIDs() []string {
+	ids := make([]string, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ipsToNames merges the entries of all containers, resolving names published by several containers according to
+// config.NameConflicts. Containers are visited in ID order, so IPs shared by several containers always get their
+// names in the same order.
+func (s containerStates) ipsToNames(config ConfigSpec) ipsToNamesMap {
+	allIPsToNames := make(ipsToNamesMap)
+
+	for _, id := range s.sortedIDs() {
+		for ip, names := range s[id].ipsToNames {
+			allIPsToNames[ip] = append(allIPsToNames[ip], names...)
+		}
+	}
+	s.resolveConflicts(allIPsToNames, config.NameConflicts)
+	for ip, names := range allIPsToNames {
+		allIPsToNames[ip] = dedupeNames(names)
+	}
+	return allIPsToNames
+}
+
+// update applies a single docker event to the known state, only inspecting the containers the event refers to
+func (s containerStates) update(client dockerClienter, event events.Message, config ConfigSpec) {
+	switch event.Type {
+	case events.ContainerEventType:
+		switch event.Action {
+		case "start":
+			s.refresh(client, event.Actor.ID, config)
+		case "die", "destroy":
+			// stopped containers' IPs are quickly handed out again, so we can't wait for them to be removed
+			delete(s, event.Actor.ID)
+		}
+	case events.NetworkEventType:
+		// network destroy events need no handling: docker refuses to remove networks with endpoints, so all
+		// containers have been disconnected (and got their own events) beforehand
+		switch event.Action {
+		case "connect", "disconnect":
+			id := event.Actor.Attributes["container"]
+			if _, ok := s[id]; !ok {
+				return // containers get connected before starting; the start event takes care of those
 			}
+			s.refresh(client, id, config)
 		}
 	}
-	return allIPsToNames, nil
 }
 
-func getIPsToNames(client dockerClienter, id string) (ipsToNamesMap, error) {
+// refresh recomputes the entries of a single container
+func (s containerStates) refresh(client dockerClienter, id string, config ConfigSpec) {
+	state, err := getContainerStateByID(client, id, config)
+	if err != nil {
+		log.Errorf("error getting container infos for %s: %s", id, err)
+		return
+	}
+	s[id] = state
+}
+
+func getContainerStateByID(client dockerClienter, id string, config ConfigSpec) (containerState, error) {
+	container := types.Container{ID: id}
+
+	// published ports are only part of the container list
+	if config.PublishedPorts {
+		containers, err := client.ContainerList(context.Background(), types.ContainerListOptions{
+			Filters: filters.NewArgs(filters.Arg("id", id)),
+		})
+		if err != nil {
+			return containerState{}, err
+		}
+		for _, c := range containers {
+			if c.ID == id {
+				container = c
+			}
+		}
+	}
+
+	return getContainerState(client, container, config)
+}
+
+func getContainerState(client dockerClienter, container types.Container, config ConfigSpec) (containerState, error) {
 	ipsToNames := make(ipsToNamesMap)
 
 	// ContainerList does not return all info, like Aliases
 	// see: curl --unix-socket /var/run/docker.sock http://localhost/containers/json
-	containerFull, err := client.ContainerInspect(context.Background(), id)
+	containerFull, err := client.ContainerInspect(context.Background(), container.ID)
 	if err != nil {
-		return nil, err
+		return containerState{}, err
+	}
+
+	containerName := strings.Trim(containerFull.Name, "/")
+	labels := containerFull.Config.Labels
+
+	state := containerState{name: containerName, ipsToNames: ipsToNames}
+	if containerFull.Created != "" {
+		if state.created, err = time.Parse(time.RFC3339Nano, containerFull.Created); err != nil {
+			log.Warnf("could not parse creation time of container %s: %s", containerName, err)
+		}
+	}
+
+	if !isEnabled(labels, config) {
+		log.Debugf("skipping disabled container %s", containerName)
+		return state, nil
+	}
+
+	// compose container names depend on the compose version and replica index, so we prefer the stable service name;
+	// names explicitly set with container_name are kept, though
+	baseNames := []string{containerName}
+	if config.ComposeServiceNames && labels[composeProjectLabel] != "" && labels[composeServiceLabel] != "" {
+		if isComposeGeneratedName(containerName, labels) {
+			baseNames = nil
+		}
+		baseNames = append(baseNames, labels[composeServiceLabel])
+		if number := labels[composeNumberLabel]; number != "" {
+			baseNames = append(baseNames, fmt.Sprintf("%s-%s", labels[composeServiceLabel], number))
+		}
+	}
+
+	hostnamesLabelValue, hasHostnames := labels[hostnamesLabel]
+	hostnames := parseHostnamesLabel(hostnamesLabel, hostnamesLabelValue)
+	labelAliases := parseHostnamesLabel(aliasesLabel, labels[aliasesLabel])
+	extraHosts := parseExtraHostsLabel(labels[dockerLabel])
+
+	domain := config.Domain
+	if label, ok := labels[domainLabel]; ok {
+		domain = label
 	}
 
 	for netName, netInfo := range containerFull.NetworkSettings.Networks {
 		if netName == "none" {
 			continue
 		}
+		if !isNetworkPublished(netName, labels, config) {
+			log.Debugf("skipping network %s of container %s", netName, containerName)
+			continue
+		}
+
+		var ips []string
+		if netName == "host" {
+			// containers sharing the host's network stack have no address of their own
+			ips = getHostNetworkIPs(config)
+		} else {
+			ips = getNetworkIPs(netInfo, config)
+		}
+		if netName == "bridge" && config.wantLinkLocalIPv6() && containerFull.NetworkSettings.LinkLocalIPv6Address != "" {
+			// the default bridge network reports its link-local address container-wide
+			ips = append(ips, containerFull.NetworkSettings.LinkLocalIPv6Address)
+		}
+		if len(ips) == 0 {
+			continue
+		}
 
-		names := make([]string, 0, 4) // 4 is worst-case size if container in a compose project (see below)
+		var names []string
 
-		maybeAppendNet := func(names []string, name string) []string {
-			if netName != "bridge" {
-				return append(names, fmt.Sprintf("%s.%s", name, netName))
-			}
-			return names
+		appendNames := func(names []string, name, alias string) []string {
+			log.Debugf("found base name %s with IPs %s", name, ips)
+			generated := executeNameTemplate(config.getNameTemplate(), nameTemplateData{
+				Name:          name,
+				ContainerName: containerName,
+				Alias:         alias,
+				Network:       netName,
+				Project:       labels[composeProjectLabel],
+				Service:       labels[composeServiceLabel],
+				Number:        labels[composeNumberLabel],
+				Labels:        labels,
+			})
+			return append(names, appendDomain(generated, domain, config.KeepBareNames)...)
 		}
 
-		appendNames := func(names []string, name string) []string {
-			log.Debugf("found base name %s with IP %s", name, netInfo.IPAddress)
-			names = append(names, fmt.Sprintf("%s", name))
-			names = maybeAppendNet(names, name)
-			if proj, ok := containerFull.Config.Labels["com.docker.compose.project"]; ok {
-				names = append(names, fmt.Sprintf("%s.%s", name, proj))
-				names = maybeAppendNet(names, fmt.Sprintf("%s.%s", name, proj))
+		if hasHostnames {
+			names = append(names, hostnames...)
+		} else {
+			for _, name := range baseNames {
+				names = appendNames(names, name, "")
+			}
+			for _, alias := range netInfo.Aliases {
+				names = appendNames(names, alias, alias)
+			}
+			for _, alias := range labelAliases {
+				names = appendNames(names, alias, alias)
 			}
-			return names
 		}
 
-		validateHostname := func(hosts ...string) []string {
-			var validHosts []string
+		names = append(names, extraHosts.all...)
+		names = append(names, extraHosts.perNetwork[netName]...)
 
-			for _, host := range hosts {
-				matches, err := regexp.MatchString("^[a-zA-Z][a-zA-Z0-9.-]*[a-zA-Z0-9]$", host)
-	
-				if err != nil {
-					log.Fatal(err)
-				}
-	
-				if matches {
-					validHosts = append(validHosts, host)
-				} else {
-					log.Warnf("Skipping '%s' doas not seem a valid hostname.", host)
+		for _, ip := range ips {
+			// each IP gets its own copy, since they might be appended to independently later on
+			ipsToNames[ip] = append([]string(nil), names...)
+		}
+	}
+
+	if config.PublishedPorts {
+		if publishedIPs := getPublishedIPs(container.Ports, config); len(publishedIPs) > 0 {
+			log.Debugf("publishing container %s at %s", containerName, publishedIPs)
+			ipsToNames = moveToIPs(ipsToNames, publishedIPs)
+		}
+	}
+
+	for ip, names := range extraHosts.perIP {
+		ipsToNames[ip] = append(ipsToNames[ip], names...)
+	}
+
+	addWildcards(ipsToNames, parseHostnamesLabel(wildcardLabel, labels[wildcardLabel]))
+
+	canonical := strings.TrimSpace(labels[canonicalLabel])
+	found := false
+	for ip, names := range ipsToNames {
+		if len(names) == 0 {
+			// e.g. empty hostnames label or name template producing nothing for this network
+			delete(ipsToNames, ip)
+			continue
+		}
+		ipsToNames[ip] = orderNames(names, canonical, config.CanonicalName)
+		found = found || (canonical != "" && ipsToNames[ip][0] == canonical)
+	}
+	if canonical != "" && !found {
+		log.Warnf("canonical name %s is not one of the names of container %s", canonical, containerName)
+	}
+
+	state.ipsToNames = ipsToNames
+	return state, nil
+}
+
+// isComposeGeneratedName reports whether the container name was generated by docker-compose, i.e.
+// PROJECT_SERVICE_NUMBER (compose v1) or PROJECT-SERVICE-NUMBER (compose v2)
+func isComposeGeneratedName(name string, labels map[string]string) bool {
+	parts := []string{labels[composeProjectLabel], labels[composeServiceLabel], labels[composeNumberLabel]}
+	return name == strings.Join(parts, "_") || name == strings.Join(parts, "-")
+}
+
+// addWildcards adds a wildcard name (*.NAME) next to each of the given names
+func addWildcards(ipsToNames ipsToNamesMap, wildcards []string) {
+	for _, wildcard := range wildcards {
+		found := false
+		for ip, names := range ipsToNames {
+			for _, name := range names {
+				if name == wildcard {
+					ipsToNames[ip] = append(ipsToNames[ip], wildcardPrefix+wildcard)
+					found = true
+					break
 				}
 			}
-	
-			return validHosts
 		}
-	
-		names = appendNames(names, strings.Trim(containerFull.Name, "/"))
-		for _, name := range netInfo.Aliases {
-			names = appendNames(names, name)
+		if !found {
+			log.Warnf("wildcard name %s is not one of the container's names", wildcard)
 		}
+	}
+}
 
-		if label, ok := containerFull.Config.Labels[dockerLabel]; ok {
-			label = strings.TrimSpace(label)
-			if (strings.HasPrefix(label, "[")) {
-				var parsed []string
-				err := json.Unmarshal([]byte(label), &parsed)
-				if err != nil {
-					log.Errorf("error parsing JSON: %s", err)
-				}
-				names = append(names, validateHostname(parsed...)...)
-			} else if (strings.HasPrefix(label, `"`)) {
-				var parsed string; 
-				err := json.Unmarshal([]byte(label), &parsed)
-				if err != nil {
-					log.Errorf("error parsing JSON: %s", err)
+// resolveConflicts handles names published by several containers for different IPs according to the given policy,
+// removing them from the merged entries where needed. A name published by a single container for several IPs (e.g.
+// on several networks) or by several containers for the same IP is not considered a conflict.
+func (s containerStates) resolveConflicts(ipsToNames ipsToNamesMap, policy string) {
+	owners := make(map[string]map[string][]string) // name -> container ID -> IPs
+	for id, state := range s {
+		for ip, names := range state.ipsToNames {
+			for _, name := range names {
+				if owners[name] == nil {
+					owners[name] = make(map[string][]string)
 				}
-				names = append(names, validateHostname(parsed)...)
-			} else if (strings.HasPrefix(label, "{")) {
-				log.Errorf("JSON objects are not supported: %s", label)
+				owners[name][id] = append(owners[name][id], ip)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(owners))
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(owners[name]) < 2 {
+			continue
+		}
+		allIPs := make(map[string]bool)
+		for _, ips := range owners[name] {
+			for _, ip := range ips {
+				allIPs[ip] = true
+			}
+		}
+		if len(allIPs) < 2 {
+			continue
+		}
+
+		ids := make([]string, 0, len(owners[name]))
+		for id := range owners[name] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		// oldest first; IDs only break ties
+		sort.SliceStable(ids, func(i, j int) bool { return s[ids[i]].created.Before(s[ids[j]].created) })
+		involved := make([]string, 0, len(ids))
+		for _, id := range ids {
+			involved = append(involved, fmt.Sprintf("%s (%s)", s[id].name, strings.Join(sortIPs(owners[name][id]), " ")))
+		}
+
+		var keep []string
+		switch policy {
+		case nameConflictsFirstWins:
+			keep = owners[name][ids[0]]
+		case nameConflictsNewestWins:
+			keep = owners[name][ids[len(ids)-1]]
+		case nameConflictsDropAmbiguous:
+		default:
+			// not worth a warning on every write: shared short names are expected e.g. for scaled compose services
+			log.Infof("name %s is published by several containers: %s", name, strings.Join(involved, ", "))
+			continue
+		}
+		if keep == nil {
+			log.Warnf("name %s is published by several containers: %s; dropping it", name, strings.Join(involved, ", "))
+		} else {
+			log.Warnf("name %s is published by several containers: %s; keeping it only for %s", name, strings.Join(involved, ", "), sortIPs(keep))
+		}
+
+		for ip := range allIPs {
+			if containsString(keep, ip) {
+				continue
+			}
+			ipsToNames[ip] = removeString(ipsToNames[ip], name)
+			if len(ipsToNames[ip]) == 0 {
+				delete(ipsToNames, ip)
+			}
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	kept := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// orderNames removes duplicate names and moves the canonical name to the front, keeping the order of the others. The
+// canonical name is the given one if present, or else picked according to the policy.
+func orderNames(names []string, canonical, policy string) []string {
+	names = dedupeNames(names)
+
+	pick := -1
+	for i, name := range names {
+		if name == canonical {
+			pick = i
+			break
+		}
+	}
+	if pick < 0 {
+		for i, name := range names {
+			if strings.HasPrefix(name, wildcardPrefix) {
+				continue // not an actual name
+			}
+			if pick < 0 ||
+				policy == canonicalNameShortest && len(name) < len(names[pick]) ||
+				policy == canonicalNameLongest && len(name) > len(names[pick]) {
+				pick = i
+			}
+		}
+	}
+	if pick <= 0 {
+		return names
+	}
+
+	ordered := make([]string, 0, len(names))
+	ordered = append(ordered, names[pick])
+	ordered = append(ordered, names[:pick]...)
+	return append(ordered, names[pick+1:]...)
+}
+
+// dedupeNames returns the names without repetitions, keeping the first occurrence of each
+func dedupeNames(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	deduped := make([]string, 0, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			deduped = append(deduped, name)
+		}
+	}
+	return deduped
+}
+
+// getPublishedIPs returns the host addresses the container's ports are published on, replacing unspecified addresses
+// (i.e. ports bound on all interfaces) with the configured loopback address
+func getPublishedIPs(ports []types.Port, config ConfigSpec) []string {
+	var ips []string
+	seen := make(map[string]bool)
+
+	for _, port := range ports {
+		if port.PublicPort == 0 {
+			continue // exposed, but not published
+		}
+		ip := net.ParseIP(port.IP)
+		if ip == nil {
+			continue
+		}
+		if ip.IsUnspecified() {
+			if ip.To4() != nil {
+				ip = net.ParseIP(config.PublishedPortsAddress)
 			} else {
-				names = append(names, validateHostname(label)...)
+				ip = net.IPv6loopback
+			}
+		}
+		if ip == nil || (ip.To4() != nil && !config.wantIPv4()) || (ip.To4() == nil && !config.wantIPv6()) {
+			continue
+		}
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips
+}
+
+// moveToIPs returns a map with all names of the given map assigned to each of the given IPs. Names are taken in IP
+// order and de-duplicated.
+func moveToIPs(ipsToNames ipsToNamesMap, ips []string) ipsToNamesMap {
+	oldIPs := make([]string, 0, len(ipsToNames))
+	for ip := range ipsToNames {
+		oldIPs = append(oldIPs, ip)
+	}
+	sort.Strings(oldIPs)
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, ip := range oldIPs {
+		for _, name := range ipsToNames[ip] {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	moved := make(ipsToNamesMap, len(ips))
+	for _, ip := range ips {
+		moved[ip] = append([]string(nil), names...)
+	}
+	return moved
+}
+
+// nameTemplateData is what name templates get executed with, once for each base name (i.e. the container name, or
+// the docker-compose service names, and each of the aliases)
+type nameTemplateData struct {
+	Name          string // the base name
+	ContainerName string
+	Alias         string // empty when executed for the container name
+	Network       string
+	Project       string // docker-compose project, if any
+	Service       string // docker-compose service, if any
+	Number        string // docker-compose replica number, if any
+	Labels        map[string]string
+}
+
+// defaultNameTemplate generates NAME, NAME.NETWORK, NAME.PROJECT and NAME.PROJECT.NETWORK, leaving out the network
+// name for the default bridge network
+const defaultNameTemplate = `{{.Name}}` +
+	`{{if ne .Network "bridge"}} {{.Name}}.{{.Network}}{{end}}` +
+	`{{with .Project}} {{$.Name}}.{{.}}{{if ne $.Network "bridge"}} {{$.Name}}.{{.}}.{{$.Network}}{{end}}{{end}}`
+
+var defaultParsedNameTemplate = template.Must(parseNameTemplate(defaultNameTemplate))
+
+func parseNameTemplate(text string) (*template.Template, error) {
+	return template.New("names").Option("missingkey=zero").Parse(text)
+}
+
+// executeNameTemplate returns the whitespace-separated names generated by the template. If the template fails, only
+// the base name is used.
+func executeNameTemplate(tmpl *template.Template, data nameTemplateData) []string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Errorf("error executing name template for %s: %s", data.Name, err)
+		return []string{data.Name}
+	}
+	return strings.Fields(buf.String())
+}
+
+// appendDomain returns the names with the domain suffix appended, optionally keeping the bare names as well. Names
+// already ending in the domain are left as they are.
+func appendDomain(names []string, domain string, keepBare bool) []string {
+	domain = strings.Trim(domain, ".")
+	if domain == "" {
+		return names
+	}
+
+	withDomain := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, "."+domain) {
+			withDomain = append(withDomain, name)
+			continue
+		}
+		withDomain = append(withDomain, name+"."+domain)
+		if keepBare {
+			withDomain = append(withDomain, name)
+		}
+	}
+	return withDomain
+}
+
+// getNetworkIPs returns the addresses of a container's network endpoint matching the configured IP family
+func getNetworkIPs(netInfo *network.EndpointSettings, config ConfigSpec) []string {
+	ipv4, ipv6 := netInfo.IPAddress, netInfo.GlobalIPv6Address
+	// some drivers (e.g. ipvlan in L3 mode) may only report statically assigned addresses in the IPAM config
+	if netInfo.IPAMConfig != nil {
+		if ipv4 == "" {
+			ipv4 = netInfo.IPAMConfig.IPv4Address
+		}
+		if ipv6 == "" {
+			ipv6 = netInfo.IPAMConfig.IPv6Address
+		}
+	}
+
+	var ips []string
+	if config.wantIPv4() && ipv4 != "" {
+		ips = append(ips, ipv4)
+	}
+	if config.wantIPv6() && ipv6 != "" {
+		ips = append(ips, ipv6)
+	}
+	if config.wantLinkLocalIPv6() && netInfo.IPAMConfig != nil {
+		for _, ip := range netInfo.IPAMConfig.LinkLocalIPs {
+			if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil && parsed.IsLinkLocalUnicast() {
+				ips = append(ips, ip)
 			}
 		}
+	}
+	return ips
+}
 
-		ipsToNames[netInfo.IPAddress] = names
+// getHostNetworkIPs returns the addresses to publish containers using the host network with. The configured
+// HostNetworkAddress may either be an IP or the name of an interface, whose addresses matching the configured IP
+// family are used.
+func getHostNetworkIPs(config ConfigSpec) []string {
+	if config.HostNetworkAddress == "" {
+		return nil
+	}
+	if ip := net.ParseIP(config.HostNetworkAddress); ip != nil {
+		return []string{ip.String()}
 	}
 
-	return ipsToNames, nil
+	iface, err := net.InterfaceByName(config.HostNetworkAddress)
+	if err != nil {
+		log.Errorf("could not get host network address: %s", err)
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		log.Errorf("could not get addresses of %s: %s", iface.Name, err)
+		return nil
+	}
+
+	var ips []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		switch {
+		case ip.To4() != nil:
+			if config.wantIPv4() {
+				ips = append(ips, ip.String())
+			}
+		case ip.IsLinkLocalUnicast():
+			if config.wantLinkLocalIPv6() {
+				ips = append(ips, ip.String())
+			}
+		default:
+			if config.wantIPv6() {
+				ips = append(ips, ip.String())
+			}
+		}
+	}
+	return ips
 }
 
-func syncAndListenForEvents(client dockerClienter, config ConfigSpec) {
+// publishFunc makes the given entries available, e.g. by writing them to the hosts file
+type publishFunc func(ipsToNamesMap) error
+
+func syncAndListenForEvents(client dockerClienter, config ConfigSpec, publish publishFunc) {
 
 	eventOpts := types.EventsOptions{
 		Filters: filters.NewArgs(
-			filters.Arg("type", "container"),
+			filters.Arg("type", events.ContainerEventType),
+			filters.Arg("type", events.NetworkEventType),
 			filters.Arg("event", "start"),
+			filters.Arg("event", "die"),
 			filters.Arg("event", "destroy"),
+			filters.Arg("event", "connect"),
+			filters.Arg("event", "disconnect"),
 		),
 	}
 
-	// helper channel to ensure we run once without
-	kickoff := make(chan bool, 1)
-	kickoff <- true
-	defer close(kickoff)
+	// periodic full resync as safety net against missed events; nil channel (i.e. never) if disabled
+	var resync <-chan time.Time
+	if config.ResyncInterval > 0 {
+		ticker := time.NewTicker(config.ResyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
 
+	// subscribe before the initial sync, so we don't miss events in between
 	events, errors := client.Events(context.Background(), eventOpts)
+
+	log.Infof("running initial sync")
+	states, err := getAllAndWrite(client, config, publish)
+	if err != nil {
+		// without the complete state, the next event would drop all other entries; let the caller reconnect instead
+		log.Error(err)
+		return
+	}
+
+	pending := &debouncer{interval: config.DebounceInterval, maxDelay: config.DebounceMaxDelay}
+	defer pending.stop()
+
 loop:
 	for {
 		select {
-		case <-kickoff:
-			log.Infof("running initial sync")
-			getAndWrite(client, config)
+		case <-resync:
+			log.Infof("running periodic sync")
+			if newStates, err := getAllAndWrite(client, config, publish); err != nil {
+				// the pending write (if any) still has to publish the changes from events
+				log.Errorf("%s; keeping previous state", err)
+			} else {
+				pending.stop() // superseded by the full write
+				states = newStates
+			}
 		case event := <-events:
-			log.Infof("got %s event for %s", event.Action, event.Actor.Attributes["name"])
-			getAndWrite(client, config)
+			log.Infof("got %s %s event for %s", event.Type, event.Action, event.Actor.Attributes["name"])
+			states.update(client, event, config)
+			if config.DebounceInterval <= 0 {
+				writeStates(states, config, publish)
+			} else {
+				pending.trigger(time.Now())
+			}
+		case <-pending.C():
+			pending.stop()
+			writeStates(states, config, publish)
 		case err := <-errors:
 			log.Errorf("error fetching event: %s", err)
 			break loop
@@ -174,20 +734,75 @@ loop:
 	}
 }
 
-func getAndWrite(client dockerClienter, config ConfigSpec) {
+// getAllAndWrite fetches the state of all containers and writes it
+func getAllAndWrite(client dockerClienter, config ConfigSpec, publish publishFunc) (containerStates, error) {
 	log.Info("fetching container infos")
-	currentContent, err := getAllIPsToNames(client)
+	states, err := getAllContainerStates(client, config)
 	if err != nil {
-		log.Errorf("error getting container infos: %s", err)
+		return nil, fmt.Errorf("error getting container infos: %s", err)
 	}
 
+	writeStates(states, config, publish)
+	return states, nil
+}
+
+func writeStates(states containerStates, config ConfigSpec, publish publishFunc) {
 	log.Info("writing current state")
-	err = writeToEtcHosts(currentContent, config)
+	err := publish(states.ipsToNames(config))
 	if err != nil {
 		log.Errorf("error syncing hosts: %s", err)
 	}
 }
 
+// debouncer coalesces bursts of events into a single write. Each trigger delays the write by interval, but never
+// further than maxDelay after the first pending trigger, so a constant stream of events cannot starve updates.
+type debouncer struct {
+	interval, maxDelay time.Duration
+
+	timer *time.Timer
+	first time.Time
+}
+
+func (d *debouncer) trigger(now time.Time) {
+	if d.first.IsZero() {
+		d.first = now
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.NewTimer(d.delay(now))
+}
+
+// delay returns how long to wait, from now, before firing
+func (d *debouncer) delay(now time.Time) time.Duration {
+	delay := d.interval
+	if d.maxDelay > 0 {
+		if remaining := d.first.Add(d.maxDelay).Sub(now); remaining < delay {
+			delay = remaining
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// C returns the channel the pending write fires on; nil (i.e. never) if nothing is pending
+func (d *debouncer) C() <-chan time.Time {
+	if d.timer == nil {
+		return nil
+	}
+	return d.timer.C
+}
+
+func (d *debouncer) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = nil
+	d.first = time.Time{}
+}
+
 func waitForConnection(client dockerClientPinger) {
 	err := backoff.Retry(func() error {
 		log.Info("attempting connection to docker")
@@ -4,8 +4,13 @@ import (
 	"context"
 	"errors"
 	"io/ioutil"
+	"net"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 
 	"docker.io/go-docker/api/types"
 	"docker.io/go-docker/api/types/container"
@@ -27,6 +32,11 @@ func (testClient) ContainerList(_ context.Context, _ types.ContainerListOptions)
 			Names: []string{
 				"/someservice",
 			},
+			Ports: []types.Port{
+				{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+				{IP: "::", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+				{PrivatePort: 443, Type: "tcp"},
+			},
 		},
 		{
 			ID: "222",
@@ -39,6 +49,9 @@ func (testClient) ContainerList(_ context.Context, _ types.ContainerListOptions)
 			Names: []string{
 				"/someotherproject_someotherservice_1",
 			},
+			Ports: []types.Port{
+				{IP: "127.0.0.2", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+			},
 		},
 		{
 			ID: "444",
@@ -52,6 +65,60 @@ func (testClient) ContainerList(_ context.Context, _ types.ContainerListOptions)
 				"/some_labeled_service",
 			},
 		},
+		{
+			ID: "666",
+			Names: []string{
+				"/some_dualstack_service",
+			},
+		},
+		{
+			ID: "777",
+			Names: []string{
+				"/someproject-someservice-2",
+			},
+		},
+		{
+			ID: "888",
+			Names: []string{
+				"/some_disabled_service",
+			},
+		},
+		{
+			ID: "999",
+			Names: []string{
+				"/some_enabled_service",
+			},
+		},
+		{
+			ID: "101",
+			Names: []string{
+				"/some_aliased_service",
+			},
+		},
+		{
+			ID: "102",
+			Names: []string{
+				"/some_renamed_service",
+			},
+		},
+		{
+			ID: "103",
+			Names: []string{
+				"/some_host_service",
+			},
+		},
+		{
+			ID: "104",
+			Names: []string{
+				"/some_ipvlan_service",
+			},
+		},
+		{
+			ID: "105",
+			Names: []string{
+				"/mydb",
+			},
+		},
 	}, nil
 }
 
@@ -127,7 +194,7 @@ func (testClient) ContainerInspect(_ context.Context, ID string) (types.Containe
 	case "555":
 		return types.ContainerJSON{
 			ContainerJSONBase: &types.ContainerJSONBase{Name: "service5"},
-			Config:            &container.Config{Labels: map[string]string{
+			Config: &container.Config{Labels: map[string]string{
 				dockerLabel: `["a.example.com", "b.example.com", "invalid."]`,
 			}},
 			NetworkSettings: &types.NetworkSettings{
@@ -141,6 +208,151 @@ func (testClient) ContainerInspect(_ context.Context, ID string) (types.Containe
 				},
 			},
 		}, nil
+	case "666":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service6"},
+			Config:            &container.Config{Labels: map[string]string{}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"dualnetwork": {
+						IPAddress:         "6.7.8.9",
+						GlobalIPv6Address: "fd00::6",
+						IPAMConfig: &network.EndpointIPAMConfig{
+							LinkLocalIPs: []string{"169.254.0.6", "fe80::6"},
+						},
+					},
+				},
+			},
+		}, nil
+	case "777":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "/someproject-someservice-2"},
+			Config: &container.Config{Labels: map[string]string{
+				composeProjectLabel: "someproject",
+				composeServiceLabel: "someservice",
+				composeNumberLabel:  "2",
+			}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"bridge": {
+						IPAddress: "7.8.9.10",
+					},
+				},
+			},
+		}, nil
+	case "888":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service8"},
+			Config:            &container.Config{Labels: map[string]string{enableLabel: "false"}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"bridge": {
+						IPAddress: "8.9.10.11",
+					},
+				},
+			},
+		}, nil
+	case "999":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service9"},
+			Config:            &container.Config{Labels: map[string]string{enableLabel: "true"}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"bridge": {
+						IPAddress: "9.10.11.12",
+					},
+				},
+			},
+		}, nil
+	case "101":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service101"},
+			Config: &container.Config{Labels: map[string]string{
+				aliasesLabel: `["labelalias"]`,
+				domainLabel:  "test",
+				dockerLabel:  `{"somenetwork": ["a.example.com"], "othernetwork": "b.example.com"}`,
+			}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"somenetwork": {
+						IPAddress: "10.1.0.1",
+						Aliases:   []string{"somealias"},
+					},
+					"othernetwork": {
+						IPAddress: "10.1.1.1",
+					},
+				},
+			},
+		}, nil
+	case "102":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service102"},
+			Config: &container.Config{Labels: map[string]string{
+				hostnamesLabel: `["x.example.com", "y.example.com"]`,
+				wildcardLabel:  "x.example.com, unknown.example.com",
+				dockerLabel:    `["z.example.com", "gw.example.com:10.0.0.1"]`,
+			}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"bridge": {
+						IPAddress: "10.2.0.1",
+						Aliases:   []string{"somealias"},
+					},
+				},
+			},
+		}, nil
+	case "103":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service103"},
+			Config:            &container.Config{Labels: map[string]string{}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"host": {},
+				},
+			},
+		}, nil
+	case "104":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service104"},
+			Config:            &container.Config{Labels: map[string]string{}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"someipvlan": {
+						IPAMConfig: &network.EndpointIPAMConfig{IPv4Address: "192.168.1.4"},
+					},
+				},
+			},
+		}, nil
+	case "105":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "/mydb"},
+			Config: &container.Config{Labels: map[string]string{
+				composeProjectLabel: "someproject",
+				composeServiceLabel: "db",
+				composeNumberLabel:  "1",
+			}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"bridge": {
+						IPAddress: "10.5.0.1",
+					},
+				},
+			},
+		}, nil
+	case "106":
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{Name: "service106"},
+			Config: &container.Config{Labels: map[string]string{
+				hostnamesLabel: "",
+				canonicalLabel: "web",
+			}},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"front": {IPAddress: "10.6.0.1"},
+					"back":  {IPAddress: "10.6.1.1"},
+				},
+			},
+		}, nil
 	default:
 		panic("whaaa?")
 	}
@@ -154,6 +366,41 @@ func (testClient) Ping(context.Context) (types.Ping, error) {
 	return types.Ping{}, nil
 }
 
+// eventClient wraps testClient with controllable events and counts calls to the docker API
+type eventClient struct {
+	testClient
+	events   chan events.Message
+	errors   chan error
+	listErr  error
+	lists    int
+	inspects map[string]int
+}
+
+func newEventClient() *eventClient {
+	return &eventClient{
+		events:   make(chan events.Message),
+		errors:   make(chan error),
+		inspects: make(map[string]int),
+	}
+}
+
+func (c *eventClient) ContainerList(ctx context.Context, opts types.ContainerListOptions) ([]types.Container, error) {
+	c.lists++
+	if c.listErr != nil {
+		return nil, c.listErr
+	}
+	return c.testClient.ContainerList(ctx, opts)
+}
+
+func (c *eventClient) ContainerInspect(ctx context.Context, ID string) (types.ContainerJSON, error) {
+	c.inspects[ID]++
+	return c.testClient.ContainerInspect(ctx, ID)
+}
+
+func (c *eventClient) Events(context.Context, types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return c.events, c.errors
+}
+
 type workingPinger struct{}
 
 func (workingPinger) Ping(_ context.Context) (types.Ping, error) {
@@ -172,10 +419,11 @@ func (wp *delayedPinger) Ping(_ context.Context) (types.Ping, error) {
 	return types.Ping{}, errors.New("not working yet")
 }
 
-func Test_getIPsToNames(t *testing.T) {
+func Test_getContainerStateByID(t *testing.T) {
 	type args struct {
 		client dockerClienter
 		id     string
+		config ConfigSpec
 	}
 	tests := []struct {
 		name    string
@@ -183,19 +431,19 @@ func Test_getIPsToNames(t *testing.T) {
 		want    ipsToNamesMap
 		wantErr bool
 	}{
-		{"simple query1", args{testClient{}, "111"}, ipsToNamesMap{
+		{"simple query1", args{testClient{}, "111", ConfigSpec{}}, ipsToNamesMap{
 			"1.2.3.4": []string{
 				"service1", "somealias",
 			},
 		}, false},
-		{"query with aliases and projects", args{testClient{}, "222"}, ipsToNamesMap{
+		{"query with aliases and projects", args{testClient{}, "222", ConfigSpec{}}, ipsToNamesMap{
 			"2.3.4.5": []string{
 				"service2", "service2.somenetwork", "service2.someproject", "service2.someproject.somenetwork",
 				"somealias1", "somealias1.somenetwork", "somealias1.someproject", "somealias1.someproject.somenetwork",
 				"nonuniquealias", "nonuniquealias.somenetwork", "nonuniquealias.someproject", "nonuniquealias.someproject.somenetwork",
 			},
 		}, false},
-		{"query with 2 networks", args{testClient{}, "333"}, ipsToNamesMap{
+		{"query with 2 networks", args{testClient{}, "333", ConfigSpec{}}, ipsToNamesMap{
 			"3.4.5.6": []string{
 				"service3", "service3.someothernetwork", "service3.someotherproject", "service3.someotherproject.someothernetwork",
 				"someotheralias1", "someotheralias1.someothernetwork", "someotheralias1.someotherproject", "someotheralias1.someotherproject.someothernetwork",
@@ -206,21 +454,139 @@ func Test_getIPsToNames(t *testing.T) {
 				"somesecondaryalias1", "somesecondaryalias1.somesecondarynetwork", "somesecondaryalias1.someotherproject", "somesecondaryalias1.someotherproject.somesecondarynetwork",
 			},
 		}, false},
-		{"query with label", args{testClient{}, "555"}, ipsToNamesMap{
+		{"query with label", args{testClient{}, "555", ConfigSpec{}}, ipsToNamesMap{
 			"5.6.7.8": []string{
 				"service5", "somealias", "a.example.com", "b.example.com",
 			},
 		}, false},
+		{"query with name template", args{testClient{}, "222", ConfigSpec{nameTemplate: template.Must(parseNameTemplate(
+			`{{if not .Alias}}{{.Name}}.{{.Project}}.test{{end}} {{.Name}}.{{.Network}}.test`,
+		))}}, ipsToNamesMap{
+			"2.3.4.5": []string{
+				"service2.someproject.test", "service2.somenetwork.test", "somealias1.somenetwork.test", "nonuniquealias.somenetwork.test",
+			},
+		}, false},
+		{"query with broken name template", args{testClient{}, "111", ConfigSpec{nameTemplate: template.Must(parseNameTemplate(
+			`{{.Name.Bogus}}`,
+		))}}, ipsToNamesMap{
+			"1.2.3.4": []string{"service1", "somealias"},
+		}, false},
+		{"query with domain", args{testClient{}, "111", ConfigSpec{Domain: ".docker.localhost"}}, ipsToNamesMap{
+			"1.2.3.4": []string{"service1.docker.localhost", "somealias.docker.localhost"},
+		}, false},
+		{"query with domain keeping bare names", args{testClient{}, "111", ConfigSpec{Domain: "test", KeepBareNames: true}}, ipsToNamesMap{
+			"1.2.3.4": []string{"service1.test", "service1", "somealias.test", "somealias"},
+		}, false},
+		{"query with domain and label", args{testClient{}, "555", ConfigSpec{Domain: "test"}}, ipsToNamesMap{
+			"5.6.7.8": []string{"service5.test", "somealias.test", "a.example.com", "b.example.com"},
+		}, false},
+		{"compose query with container name", args{testClient{}, "777", ConfigSpec{}}, ipsToNamesMap{
+			"7.8.9.10": []string{"someproject-someservice-2", "someproject-someservice-2.someproject"},
+		}, false},
+		{"compose query with service names", args{testClient{}, "777", ConfigSpec{ComposeServiceNames: true}}, ipsToNamesMap{
+			"7.8.9.10": []string{"someservice", "someservice.someproject", "someservice-2", "someservice-2.someproject"},
+		}, false},
+		{"compose query with custom container name", args{testClient{}, "105", ConfigSpec{ComposeServiceNames: true}}, ipsToNamesMap{
+			"10.5.0.1": []string{"mydb", "mydb.someproject", "db", "db.someproject", "db-1", "db-1.someproject"},
+		}, false},
+		{"canonical label without any names", args{testClient{}, "106", ConfigSpec{}}, ipsToNamesMap{}, false},
+		{"non-compose query with service names", args{testClient{}, "222", ConfigSpec{ComposeServiceNames: true}}, ipsToNamesMap{
+			"2.3.4.5": []string{
+				"service2", "service2.somenetwork", "service2.someproject", "service2.someproject.somenetwork",
+				"somealias1", "somealias1.somenetwork", "somealias1.someproject", "somealias1.someproject.somenetwork",
+				"nonuniquealias", "nonuniquealias.somenetwork", "nonuniquealias.someproject", "nonuniquealias.someproject.somenetwork",
+			},
+		}, false},
+		{"query with excluded network", args{testClient{}, "333", ConfigSpec{NetworksExclude: []string{"somesecondary*"}}}, ipsToNamesMap{
+			"3.4.5.6": []string{
+				"service3", "service3.someothernetwork", "service3.someotherproject", "service3.someotherproject.someothernetwork",
+				"someotheralias1", "someotheralias1.someothernetwork", "someotheralias1.someotherproject", "someotheralias1.someotherproject.someothernetwork",
+				"nonuniquealias", "nonuniquealias.someothernetwork", "nonuniquealias.someotherproject", "nonuniquealias.someotherproject.someothernetwork",
+			},
+		}, false},
+		{"query with included network", args{testClient{}, "333", ConfigSpec{NetworksInclude: []string{"somesecondarynetwork"}}}, ipsToNamesMap{
+			"4.5.6.7": []string{
+				"service3", "service3.somesecondarynetwork", "service3.someotherproject", "service3.someotherproject.somesecondarynetwork",
+				"somesecondaryalias1", "somesecondaryalias1.somesecondarynetwork", "somesecondaryalias1.someotherproject", "somesecondaryalias1.someotherproject.somesecondarynetwork",
+			},
+		}, false},
+		{"query with naming labels", args{testClient{}, "101", ConfigSpec{Domain: "ignored"}}, ipsToNamesMap{
+			"10.1.0.1": []string{
+				"service101.test", "service101.somenetwork.test",
+				"somealias.test", "somealias.somenetwork.test",
+				"labelalias.test", "labelalias.somenetwork.test",
+				"a.example.com",
+			},
+			"10.1.1.1": []string{
+				"service101.test", "service101.othernetwork.test",
+				"labelalias.test", "labelalias.othernetwork.test",
+				"b.example.com",
+			},
+		}, false},
+		{"query with hostnames label", args{testClient{}, "102", ConfigSpec{}}, ipsToNamesMap{
+			"10.2.0.1": []string{"x.example.com", "y.example.com", "z.example.com", "*.x.example.com"},
+			"10.0.0.1": []string{"gw.example.com"},
+		}, false},
+		{"query for host network container", args{testClient{}, "103", ConfigSpec{}}, ipsToNamesMap{}, false},
+		{"query for host network container with address", args{testClient{}, "103", ConfigSpec{HostNetworkAddress: "127.0.0.1"}}, ipsToNamesMap{
+			"127.0.0.1": []string{"service103", "service103.host"},
+		}, false},
+		{"query for host network container with unknown interface", args{testClient{}, "103", ConfigSpec{HostNetworkAddress: "nosuchinterface0"}}, ipsToNamesMap{}, false},
+		{"query with statically assigned address", args{testClient{}, "104", ConfigSpec{}}, ipsToNamesMap{
+			"192.168.1.4": []string{"service104", "service104.someipvlan"},
+		}, false},
+		{"query with published ports", args{testClient{}, "111", ConfigSpec{PublishedPorts: true, PublishedPortsAddress: "127.0.0.1"}}, ipsToNamesMap{
+			"127.0.0.1": []string{"service1", "somealias"},
+		}, false},
+		{"query with published ports and ipv6", args{testClient{}, "111", ConfigSpec{PublishedPorts: true, PublishedPortsAddress: "127.0.0.1", IPFamily: ipFamilyBoth}}, ipsToNamesMap{
+			"127.0.0.1": []string{"service1", "somealias"},
+			"::1":       []string{"service1", "somealias"},
+		}, false},
+		{"query with ports published on specific address", args{testClient{}, "333", ConfigSpec{PublishedPorts: true, PublishedPortsAddress: "127.0.0.1"}}, ipsToNamesMap{
+			"127.0.0.2": []string{
+				"service3", "service3.someothernetwork", "service3.someotherproject", "service3.someotherproject.someothernetwork",
+				"someotheralias1", "someotheralias1.someothernetwork", "someotheralias1.someotherproject", "someotheralias1.someotherproject.someothernetwork",
+				"nonuniquealias", "nonuniquealias.someothernetwork", "nonuniquealias.someotherproject", "nonuniquealias.someotherproject.someothernetwork",
+				"service3.somesecondarynetwork", "service3.someotherproject.somesecondarynetwork",
+				"somesecondaryalias1", "somesecondaryalias1.somesecondarynetwork", "somesecondaryalias1.someotherproject", "somesecondaryalias1.someotherproject.somesecondarynetwork",
+			},
+		}, false},
+		{"query without published ports", args{testClient{}, "999", ConfigSpec{PublishedPorts: true, PublishedPortsAddress: "127.0.0.1"}}, ipsToNamesMap{
+			"9.10.11.12": []string{"service9"},
+		}, false},
+		{"query for disabled container", args{testClient{}, "888", ConfigSpec{}}, ipsToNamesMap{}, false},
+		{"query for enabled container", args{testClient{}, "999", ConfigSpec{}}, ipsToNamesMap{
+			"9.10.11.12": []string{"service9"},
+		}, false},
+		{"query for unlabeled container in opt-in mode", args{testClient{}, "111", ConfigSpec{OptIn: true}}, ipsToNamesMap{}, false},
+		{"query for enabled container in opt-in mode", args{testClient{}, "999", ConfigSpec{OptIn: true}}, ipsToNamesMap{
+			"9.10.11.12": []string{"service9"},
+		}, false},
+		{"dual-stack query with default family", args{testClient{}, "666", ConfigSpec{}}, ipsToNamesMap{
+			"6.7.8.9": []string{"service6", "service6.dualnetwork"},
+		}, false},
+		{"dual-stack query with ipv6", args{testClient{}, "666", ConfigSpec{IPFamily: ipFamilyIPv6}}, ipsToNamesMap{
+			"fd00::6": []string{"service6", "service6.dualnetwork"},
+		}, false},
+		{"dual-stack query with both", args{testClient{}, "666", ConfigSpec{IPFamily: ipFamilyBoth}}, ipsToNamesMap{
+			"6.7.8.9": []string{"service6", "service6.dualnetwork"},
+			"fd00::6": []string{"service6", "service6.dualnetwork"},
+		}, false},
+		{"dual-stack query with link-local", args{testClient{}, "666", ConfigSpec{IPFamily: ipFamilyBoth, LinkLocalIPv6: true}}, ipsToNamesMap{
+			"6.7.8.9": []string{"service6", "service6.dualnetwork"},
+			"fd00::6": []string{"service6", "service6.dualnetwork"},
+			"fe80::6": []string{"service6", "service6.dualnetwork"},
+		}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := getIPsToNames(tt.args.client, tt.args.id)
+			got, err := getContainerStateByID(tt.args.client, tt.args.id, tt.args.config)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("getIPsToNames() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("getContainerStateByID() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("getIPsToNames():\n%v\nwant:\n%v", got, tt.want)
+			if !reflect.DeepEqual(got.ipsToNames, tt.want) {
+				t.Errorf("getContainerStateByID():\n%v\nwant:\n%v", got.ipsToNames, tt.want)
 			}
 		})
 	}
@@ -229,6 +595,7 @@ func Test_getIPsToNames(t *testing.T) {
 func Test_getAllIPsToNames(t *testing.T) {
 	type args struct {
 		client dockerClienter
+		config ConfigSpec
 	}
 	tests := []struct {
 		name    string
@@ -236,7 +603,7 @@ func Test_getAllIPsToNames(t *testing.T) {
 		want    ipsToNamesMap
 		wantErr bool
 	}{
-		{"simple query1", args{testClient{}}, ipsToNamesMap{
+		{"simple query1", args{testClient{}, ConfigSpec{}}, ipsToNamesMap{
 			"1.2.3.4": []string{"service1", "somealias"},
 			"2.3.4.5": []string{
 				"service2", "service2.somenetwork", "service2.someproject", "service2.someproject.somenetwork",
@@ -253,13 +620,31 @@ func Test_getAllIPsToNames(t *testing.T) {
 				"somesecondaryalias1", "somesecondaryalias1.somesecondarynetwork", "somesecondaryalias1.someotherproject", "somesecondaryalias1.someotherproject.somesecondarynetwork",
 			},
 			"5.6.7.8": []string{
-				"service5", "somealias", "a.example.com", "b.example.com", 
+				"service5", "somealias", "a.example.com", "b.example.com",
+			},
+			"6.7.8.9":    []string{"service6", "service6.dualnetwork"},
+			"7.8.9.10":   []string{"someproject-someservice-2", "someproject-someservice-2.someproject"},
+			"9.10.11.12": []string{"service9"},
+			"10.1.0.1": []string{
+				"service101.test", "service101.somenetwork.test",
+				"somealias.test", "somealias.somenetwork.test",
+				"labelalias.test", "labelalias.somenetwork.test",
+				"a.example.com",
+			},
+			"10.1.1.1": []string{
+				"service101.test", "service101.othernetwork.test",
+				"labelalias.test", "labelalias.othernetwork.test",
+				"b.example.com",
 			},
+			"10.2.0.1":    []string{"x.example.com", "y.example.com", "z.example.com", "*.x.example.com"},
+			"10.0.0.1":    []string{"gw.example.com"},
+			"192.168.1.4": []string{"service104", "service104.someipvlan"},
+			"10.5.0.1":    []string{"mydb", "mydb.someproject"},
 		}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := getAllIPsToNames(tt.args.client)
+			got, err := getAllIPsToNames(tt.args.client, tt.args.config)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getAllIPsToNames() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -271,6 +656,246 @@ func Test_getAllIPsToNames(t *testing.T) {
 	}
 }
 
+func Test_syncAndListenForEvents(t *testing.T) {
+	config := ConfigSpec{EtcHostsPath: tempHostsFile(t, "127.0.0.1\tlocalhost\n")}
+
+	client := newEventClient()
+	done := make(chan struct{})
+	go func() {
+		syncAndListenForEvents(client, config, newPublisher(config, nil))
+		close(done)
+	}()
+
+	// unbuffered channels: each send only returns once the previous one has been handled
+	client.events <- events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: "111"}}
+	client.events <- events.Message{Type: "container", Action: "destroy", Actor: events.Actor{ID: "222"}}
+	client.errors <- errors.New("stop")
+	<-done
+
+	if client.lists != 1 {
+		t.Errorf("expected a single container listing, got %d", client.lists)
+	}
+	if client.inspects["111"] != 2 || client.inspects["333"] != 1 {
+		t.Errorf("expected only the started container to be inspected again, got %v", client.inspects)
+	}
+
+	content, err := ioutil.ReadFile(config.EtcHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "1.2.3.4\t") {
+		t.Errorf("expected entry for started container, got:\n%s", content)
+	}
+	if strings.Contains(string(content), "2.3.4.5\t") {
+		t.Errorf("expected entry for destroyed container to be removed, got:\n%s", content)
+	}
+}
+
+func Test_syncAndListenForEvents_initialSyncFails(t *testing.T) {
+	client := newEventClient()
+	client.listErr = errors.New("daemon went away")
+
+	published := 0
+	publish := func(ipsToNames ipsToNamesMap) error {
+		published++
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		syncAndListenForEvents(client, ConfigSpec{}, publish)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected to give up after failed initial sync")
+	}
+	if published != 0 {
+		t.Errorf("expected nothing to be published, got %d writes", published)
+	}
+}
+
+func Test_getHostNetworkIPs_interface(t *testing.T) {
+	if _, err := net.InterfaceByName("lo"); err != nil {
+		t.Skip("no loopback interface named lo")
+	}
+	got := getHostNetworkIPs(ConfigSpec{HostNetworkAddress: "lo"})
+	if !reflect.DeepEqual(got, []string{"127.0.0.1"}) {
+		t.Errorf("getHostNetworkIPs() = %v, want [127.0.0.1]", got)
+	}
+}
+
+func Test_getPublishedIPs(t *testing.T) {
+	tests := []struct {
+		name   string
+		ports  []types.Port
+		config ConfigSpec
+		want   []string
+	}{
+		{"no ports", nil, ConfigSpec{PublishedPortsAddress: "127.0.0.1"}, nil},
+		{"unpublished port", []types.Port{{PrivatePort: 80}}, ConfigSpec{PublishedPortsAddress: "127.0.0.1"}, nil},
+		{"all interfaces", []types.Port{
+			{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 80},
+			{IP: "::", PrivatePort: 80, PublicPort: 80},
+			{IP: "0.0.0.0", PrivatePort: 443, PublicPort: 443},
+		}, ConfigSpec{PublishedPortsAddress: "127.0.0.1"}, []string{"127.0.0.1"}},
+		{"all interfaces with both families", []types.Port{
+			{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 80},
+			{IP: "::", PrivatePort: 80, PublicPort: 80},
+		}, ConfigSpec{PublishedPortsAddress: "127.0.0.1", IPFamily: ipFamilyBoth}, []string{"127.0.0.1", "::1"}},
+		{"custom address", []types.Port{{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 80}}, ConfigSpec{PublishedPortsAddress: "192.168.0.1"}, []string{"192.168.0.1"}},
+		{"specific addresses", []types.Port{
+			{IP: "127.0.0.2", PrivatePort: 80, PublicPort: 80},
+			{IP: "127.0.0.3", PrivatePort: 443, PublicPort: 443},
+		}, ConfigSpec{PublishedPortsAddress: "127.0.0.1"}, []string{"127.0.0.2", "127.0.0.3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getPublishedIPs(tt.ports, tt.config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getPublishedIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_appendDomain(t *testing.T) {
+	tests := []struct {
+		name     string
+		names    []string
+		domain   string
+		keepBare bool
+		want     []string
+	}{
+		{"no domain", []string{"a", "a.b"}, "", false, []string{"a", "a.b"}},
+		{"domain", []string{"a", "a.b"}, "test", false, []string{"a.test", "a.b.test"}},
+		{"domain with dots", []string{"a"}, ".test.", false, []string{"a.test"}},
+		{"keep bare", []string{"a", "a.b"}, "test", true, []string{"a.test", "a", "a.b.test", "a.b"}},
+		{"already suffixed", []string{"a.test"}, "test", true, []string{"a.test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendDomain(tt.names, tt.domain, tt.keepBare); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("appendDomain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_containerStates_update(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        events.Message
+		wantIDs      []string
+		wantInspects map[string]int
+	}{
+		{"container start", events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: "333"}},
+			[]string{"111", "222", "333"}, map[string]int{"333": 1}},
+		{"container die", events.Message{Type: "container", Action: "die", Actor: events.Actor{ID: "222"}},
+			[]string{"111"}, map[string]int{}},
+		{"container destroy", events.Message{Type: "container", Action: "destroy", Actor: events.Actor{ID: "222"}},
+			[]string{"111"}, map[string]int{}},
+		{"network connect", events.Message{Type: "network", Action: "connect", Actor: events.Actor{ID: "somenetworkid", Attributes: map[string]string{"container": "222"}}},
+			[]string{"111", "222"}, map[string]int{"222": 1}},
+		{"network connect before start", events.Message{Type: "network", Action: "connect", Actor: events.Actor{ID: "somenetworkid", Attributes: map[string]string{"container": "333"}}},
+			[]string{"111", "222"}, map[string]int{}},
+		{"network disconnect", events.Message{Type: "network", Action: "disconnect", Actor: events.Actor{ID: "somenetworkid", Attributes: map[string]string{"container": "111"}}},
+			[]string{"111", "222"}, map[string]int{"111": 1}},
+		{"network destroy", events.Message{Type: "network", Action: "destroy", Actor: events.Actor{ID: "somenetworkid"}},
+			[]string{"111", "222"}, map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newEventClient()
+			states := containerStates{"111": {}, "222": {}}
+			states.update(client, tt.event, ConfigSpec{})
+
+			var gotIDs []string
+			for id := range states {
+				gotIDs = append(gotIDs, id)
+			}
+			sort.Strings(gotIDs)
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("containerStates.update() left %v, want %v", gotIDs, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(client.inspects, tt.wantInspects) {
+				t.Errorf("containerStates.update() inspected %v, want %v", client.inspects, tt.wantInspects)
+			}
+		})
+	}
+}
+
+func Test_debouncer_delay(t *testing.T) {
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name     string
+		debounce debouncer
+		now      time.Time
+		want     time.Duration
+	}{
+		{"first trigger", debouncer{interval: time.Second, maxDelay: 5 * time.Second, first: start}, start, time.Second},
+		{"within max delay", debouncer{interval: time.Second, maxDelay: 5 * time.Second, first: start}, start.Add(3 * time.Second), time.Second},
+		{"capped by max delay", debouncer{interval: time.Second, maxDelay: 5 * time.Second, first: start}, start.Add(4500 * time.Millisecond), 500 * time.Millisecond},
+		{"past max delay", debouncer{interval: time.Second, maxDelay: 5 * time.Second, first: start}, start.Add(6 * time.Second), 0},
+		{"no max delay", debouncer{interval: time.Second, first: start}, start.Add(time.Hour), time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.debounce.delay(tt.now); got != tt.want {
+				t.Errorf("debouncer.delay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syncAndListenForEvents_debounced(t *testing.T) {
+	config := ConfigSpec{DebounceInterval: 500 * time.Millisecond}
+
+	published := make(chan ipsToNamesMap, 10)
+	publish := func(ipsToNames ipsToNamesMap) error {
+		published <- ipsToNames
+		return nil
+	}
+
+	client := newEventClient()
+	done := make(chan struct{})
+	go func() {
+		syncAndListenForEvents(client, config, publish)
+		close(done)
+	}()
+
+	<-published // initial sync
+
+	client.events <- events.Message{Type: "container", Action: "destroy", Actor: events.Actor{ID: "111"}}
+	client.events <- events.Message{Type: "container", Action: "destroy", Actor: events.Actor{ID: "222"}}
+
+	select {
+	case got := <-published:
+		t.Fatalf("expected write to be delayed, got %v", got)
+	default:
+	}
+
+	select {
+	case got := <-published:
+		if _, ok := got["1.2.3.4"]; ok {
+			t.Errorf("expected debounced write to remove both entries, got %v", got)
+		}
+		if _, ok := got["2.3.4.5"]; ok {
+			t.Errorf("expected debounced write to remove both entries, got %v", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("debounced write never happened")
+	}
+
+	client.errors <- errors.New("stop")
+	<-done
+
+	if len(published) != 0 {
+		t.Errorf("expected a single debounced write, got %d more", len(published))
+	}
+}
+
 func Test_waitForConnection(t *testing.T) {
 	type args struct {
 		client dockerClientPinger
@@ -292,3 +917,72 @@ func Test_waitForConnection(t *testing.T) {
 		})
 	}
 }
+
+func Test_orderNames(t *testing.T) {
+	names := []string{"svc", "svc.net", "svc", "longalias.net", "*.svc"}
+	tests := []struct {
+		name      string
+		canonical string
+		policy    string
+		want      []string
+	}{
+		{"first", "", canonicalNameFirst, []string{"svc", "svc.net", "longalias.net", "*.svc"}},
+		{"shortest", "", canonicalNameShortest, []string{"svc", "svc.net", "longalias.net", "*.svc"}},
+		{"longest", "", canonicalNameLongest, []string{"longalias.net", "svc", "svc.net", "*.svc"}},
+		{"canonical label", "svc.net", canonicalNameLongest, []string{"svc.net", "svc", "longalias.net", "*.svc"}},
+		{"unknown canonical label", "other", canonicalNameFirst, []string{"svc", "svc.net", "longalias.net", "*.svc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderNames(names, tt.canonical, tt.policy); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_containerStates_ipsToNames_conflicts(t *testing.T) {
+	states := containerStates{
+		"aaa": {name: "old", created: time.Unix(100, 0), ipsToNames: ipsToNamesMap{
+			"1.1.1.1": {"db", "db.old"},
+			"1.1.2.1": {"db", "db.old", "gw"},
+		}},
+		"bbb": {name: "new", created: time.Unix(200, 0), ipsToNames: ipsToNamesMap{
+			"2.2.2.2": {"db", "db.new"},
+			"1.1.2.1": {"gw"},
+		}},
+	}
+	tests := []struct {
+		name   string
+		policy string
+		want   ipsToNamesMap
+	}{
+		{"keep all", nameConflictsKeepAll, ipsToNamesMap{
+			"1.1.1.1": {"db", "db.old"},
+			"1.1.2.1": {"db", "db.old", "gw"},
+			"2.2.2.2": {"db", "db.new"},
+		}},
+		{"first wins", nameConflictsFirstWins, ipsToNamesMap{
+			"1.1.1.1": {"db", "db.old"},
+			"1.1.2.1": {"db", "db.old", "gw"},
+			"2.2.2.2": {"db.new"},
+		}},
+		{"newest wins", nameConflictsNewestWins, ipsToNamesMap{
+			"1.1.1.1": {"db.old"},
+			"1.1.2.1": {"db.old", "gw"},
+			"2.2.2.2": {"db", "db.new"},
+		}},
+		{"drop ambiguous", nameConflictsDropAmbiguous, ipsToNamesMap{
+			"1.1.1.1": {"db.old"},
+			"1.1.2.1": {"db.old", "gw"},
+			"2.2.2.2": {"db.new"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := states.ipsToNames(ConfigSpec{NameConflicts: tt.policy}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("containerStates.ipsToNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	banner = "# !!! managed by docker-etchosts !!!"
+	beginMarker    = "# BEGIN docker-etchosts" // followed by the instance ID, if any
+	endMarker      = "# END docker-etchosts"
+	legacyBanner   = "# !!! managed by docker-etchosts !!!" // used to precede each managed entry
+	wildcardPrefix = "*."
 )
 
 func writeToEtcHosts(ipsToNames ipsToNamesMap, config ConfigSpec) error {
@@ -25,6 +31,22 @@ func writeToEtcHosts(ipsToNames ipsToNamesMap, config ConfigSpec) error {
 	}
 	defer etcHosts.Close()
 
+	oldContent, err := ioutil.ReadAll(etcHosts)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", config.EtcHostsPath, err)
+	}
+
+	newContent, err := generateEtcHosts(oldContent, ipsToNames, config)
+	if err != nil {
+		return err
+	}
+
+	// avoid needlessly bumping mtime and waking up anything watching the file
+	if bytes.Equal(oldContent, newContent) {
+		log.Debugf("%s already up to date; not writing", config.EtcHostsPath)
+		return nil
+	}
+
 	// create tmpfile in same folder as
 	tmp, err := ioutil.TempFile(path.Dir(config.EtcHostsPath), "docker-etchosts")
 	if err != nil {
@@ -39,58 +61,263 @@ func writeToEtcHosts(ipsToNames ipsToNamesMap, config ConfigSpec) error {
 		}
 	}(tmp)
 
-	// go through file and update existing entries/prune nonexistent entries
-	managedLine := false
-	scanner := bufio.NewScanner(etcHosts)
+	if _, err := tmp.Write(newContent); err != nil {
+		return fmt.Errorf("could not write to %s: %s", tmp.Name(), err)
+	}
+
+	err = movePreservePerms(tmp, etcHosts)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blockMarkers returns the markers delimiting the managed block of the given instance
+func blockMarkers(instanceID string) (string, string) {
+	if instanceID == "" {
+		return beginMarker, endMarker
+	}
+	return beginMarker + " " + instanceID, endMarker + " " + instanceID
+}
+
+// generateEtcHosts returns the given hosts file content with the managed block replaced by the given entries.
+// Entries in the legacy format (each preceded by its own banner) are migrated into the block of the default instance;
+// blocks of other instances are left alone like any unmanaged lines.
+func generateEtcHosts(content []byte, ipsToNames ipsToNamesMap, config ConfigSpec) ([]byte, error) {
+	ipsToNames = expandWildcards(ipsToNames, config.WildcardSubdomains)
+	begin, end := blockMarkers(config.InstanceID)
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
 	for scanner.Scan() {
-		line := scanner.Text()
-		if line == banner {
-			managedLine = true
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error parsing hosts file: %s", err)
+	}
+
+	// first pass: remove managed lines, remembering where they were, and index the names set by the remaining ones
+	var unmanagedLines []string
+	unmanaged := make(map[string][]string) // lowercase name -> IPs
+	blockAt := -1
+	for i := 0; i < len(lines); i++ {
+		switch {
+		case lines[i] == begin:
+			if blockAt < 0 {
+				blockAt = len(unmanagedLines)
+			}
+			i = skipManagedBlock(lines, i, begin, end)
+			continue
+		case lines[i] == end:
+			// without a matching begin marker, it would otherwise end up before the new block
+			log.Warnf("removing %q without matching %q from hosts file", end, begin)
+			continue
+		case lines[i] == legacyBanner && config.InstanceID == "":
+			if blockAt < 0 {
+				blockAt = len(unmanagedLines)
+			}
+			// only skip the following line if it's actually an entry, so a lone banner doesn't eat unrelated lines
+			if i+1 < len(lines) && isHostsEntry(lines[i+1]) {
+				i++
+			}
 			continue
 		}
-		if managedLine {
-			managedLine = false
-			tokens := strings.Fields(line)
-			if len(tokens) < 1 {
-				continue // remove empty managed line
+
+		unmanagedLines = append(unmanagedLines, lines[i])
+		ip, names := parseHostsLine(lines[i])
+		for _, name := range names {
+			unmanaged[strings.ToLower(name)] = append(unmanaged[strings.ToLower(name)], ip)
+		}
+	}
+
+	ipsToNames = resolveUnmanagedConflicts(ipsToNames, unmanaged, config.UnmanagedConflicts)
+
+	// the block stays where it was, or is appended if there was none
+	if blockAt < 0 {
+		blockAt = len(unmanagedLines)
+	}
+	// managed entries overriding unmanaged ones must come first, since resolvers use the first match
+	if config.UnmanagedConflicts == unmanagedConflictsOverride {
+		for i, line := range unmanagedLines[:blockAt] {
+			if conflictsWith(line, ipsToNames) {
+				blockAt = i
+				break
 			}
-			ip := tokens[0]
-			if names, ok := ipsToNames[ip]; ok {
-				err = writeEntryWithBanner(tmp, ip, names)
-				if err != nil {
-					return err
+		}
+	}
+
+	// second pass: write unmanaged lines with the managed block in between
+	var buf bytes.Buffer
+	for _, line := range unmanagedLines[:blockAt] {
+		fmt.Fprintf(&buf, "%s\n", line)
+	}
+	if err := writeManagedBlock(&buf, ipsToNames, begin, end); err != nil {
+		return nil, err
+	}
+	for _, line := range unmanagedLines[blockAt:] {
+		fmt.Fprintf(&buf, "%s\n", line)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// skipManagedBlock returns the index of the last line of the managed block starting at the given index. If the end
+// marker is missing, only the entries directly following the begin marker are considered part of the block.
+func skipManagedBlock(lines []string, start int, begin, end string) int {
+	for i := start + 1; i < len(lines) && lines[i] != begin; i++ {
+		if lines[i] == end {
+			return i
+		}
+	}
+
+	log.Warnf("missing %q in hosts file; only considering entries directly following %q as managed", end, begin)
+	i := start
+	for i+1 < len(lines) && isHostsEntry(lines[i+1]) {
+		i++
+	}
+	return i
+}
+
+// isHostsEntry reports whether the line is a valid hosts file entry, as opposed to e.g. comments or blank lines
+func isHostsEntry(line string) bool {
+	ip, _ := parseHostsLine(line)
+	return ip != ""
+}
+
+// conflictsWith reports whether the unmanaged line sets any of the given names for a different IP
+func conflictsWith(line string, ipsToNames ipsToNamesMap) bool {
+	lineIP, lineNames := parseHostsLine(line)
+	for ip, names := range ipsToNames {
+		if ip == lineIP {
+			continue
+		}
+		for _, name := range names {
+			for _, lineName := range lineNames {
+				if strings.EqualFold(name, lineName) {
+					return true
 				}
-				delete(ipsToNames, ip) // otherwise we'll append it again below
 			}
-		} else {
-			// keep original unmanaged line
-			fmt.Fprintf(tmp, "%s\n", line)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading %s: %s", config.EtcHostsPath, err)
+	return false
+}
+
+// parseHostsLine returns the IP and names of a hosts file entry, or nothing for comments, blank or invalid lines
+func parseHostsLine(line string) (string, []string) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+// resolveUnmanagedConflicts handles managed names which unmanaged entries already set for other IPs according to the
+// given policy, returning the resulting entries
+func resolveUnmanagedConflicts(ipsToNames ipsToNamesMap, unmanaged map[string][]string, policy string) ipsToNamesMap {
+	resolved := make(ipsToNamesMap, len(ipsToNames))
+	for _, ip := range sortedIPs(ipsToNames) {
+		names := make([]string, 0, len(ipsToNames[ip]))
+		for _, name := range ipsToNames[ip] {
+			var others []string
+			for _, other := range unmanaged[strings.ToLower(name)] {
+				if other != ip {
+					others = append(others, other)
+				}
+			}
+			if len(others) == 0 {
+				names = append(names, name)
+				continue
+			}
+
+			switch policy {
+			case unmanagedConflictsWarn:
+				log.Warnf("name %s for %s conflicts with unmanaged hosts entry for %s", name, ip, others)
+			case unmanagedConflictsOverride:
+				log.Warnf("name %s for %s overrides unmanaged hosts entry for %s", name, ip, others)
+			default:
+				log.Warnf("skipping name %s for %s: already set for %s by unmanaged hosts entry", name, ip, others)
+				continue
+			}
+			names = append(names, name)
+		}
+		if len(names) > 0 {
+			resolved[ip] = names
+		}
 	}
+	return resolved
+}
 
-	// append remaining entries to file
+// expandWildcards replaces wildcard names, which hosts files don't support, with the given subdomains
+func expandWildcards(ipsToNames ipsToNamesMap, subdomains []string) ipsToNamesMap {
+	expanded := make(ipsToNamesMap, len(ipsToNames))
 	for ip, names := range ipsToNames {
-		err = writeEntryWithBanner(tmp, ip, names)
-		if err != nil {
-			return err
+		expandedNames := make([]string, 0, len(names))
+		for _, name := range names {
+			if !strings.HasPrefix(name, wildcardPrefix) {
+				expandedNames = append(expandedNames, name)
+				continue
+			}
+			for _, subdomain := range subdomains {
+				expandedNames = append(expandedNames, subdomain+"."+strings.TrimPrefix(name, wildcardPrefix))
+			}
 		}
+		expanded[ip] = dedupeNames(expandedNames)
 	}
+	return expanded
+}
 
-	err = movePreservePerms(tmp, etcHosts)
-	if err != nil {
-		return err
+// sortedIPs returns the IPs of the given entries in the order of sortIPs
+func sortedIPs(ipsToNames ipsToNamesMap) []string {
+	ips := make([]string, 0, len(ipsToNames))
+	for ip := range ipsToNames {
+		ips = append(ips, ip)
 	}
+	return sortIPs(ips)
+}
+
+// sortIPs sorts the given IPs in place, IPv4 before IPv6, each numerically, and returns them
+func sortIPs(ips []string) []string {
+	sort.Slice(ips, func(i, j int) bool {
+		a, b := net.ParseIP(ips[i]), net.ParseIP(ips[j])
+		if a == nil || b == nil {
+			return ips[i] < ips[j]
+		}
+		if (a.To4() == nil) != (b.To4() == nil) {
+			return a.To4() != nil
+		}
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+	return ips
+}
 
+// writeManagedBlock writes the given entries between the block markers, sorted to keep changes between runs minimal.
+// Nothing is written if there are no entries.
+func writeManagedBlock(w io.Writer, ipsToNames ipsToNamesMap, begin, end string) error {
+	if len(ipsToNames) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", begin); err != nil {
+		return fmt.Errorf("error writing managed block: %s", err)
+	}
+	for _, ip := range sortedIPs(ipsToNames) {
+		if err := writeEntry(w, ip, ipsToNames[ip]); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", end); err != nil {
+		return fmt.Errorf("error writing managed block: %s", err)
+	}
 	return nil
 }
 
-func writeEntryWithBanner(tmp io.Writer, ip string, names []string) error {
+func writeEntry(w io.Writer, ip string, names []string) error {
 	if ip != "" && len(names) > 0 {
 		log.Debugf("writing entry for %s (%s)", ip, names)
-		if _, err := fmt.Fprintf(tmp, "%s\n%s\t%s\n", banner, ip, strings.Join(names, " ")); err != nil {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", ip, strings.Join(names, " ")); err != nil {
 			return fmt.Errorf("error writing entry for %s: %s", ip, err)
 		}
 	}
@@ -3,10 +3,15 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-func Test_writeEntryWithBanner(t *testing.T) {
+func Test_writeEntry(t *testing.T) {
 	type args struct {
 		ip    string
 		names []string
@@ -19,18 +24,164 @@ func Test_writeEntryWithBanner(t *testing.T) {
 	}{
 		{"do not write empty ip", args{"", []string{"somename", "someothername"}}, "", false},
 		{"do not write empty names", args{"1.2.3.4", []string{}}, "", false},
-		{"complete entry", args{"1.2.3.4", []string{"somename", "someothername"}}, fmt.Sprintf("%s\n1.2.3.4\tsomename someothername\n", banner), false},
+		{"complete entry", args{"1.2.3.4", []string{"somename", "someothername"}}, "1.2.3.4\tsomename someothername\n", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tmp := &bytes.Buffer{}
-			if err := writeEntryWithBanner(tmp, tt.args.ip, tt.args.names); (err != nil) != tt.wantErr {
-				t.Errorf("writeEntryWithBanner() error = %v, wantErr %v", err, tt.wantErr)
+			if err := writeEntry(tmp, tt.args.ip, tt.args.names); (err != nil) != tt.wantErr {
+				t.Errorf("writeEntry() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if gotTmp := tmp.String(); gotTmp != tt.wantTmp {
-				t.Errorf("writeEntryWithBanner() got:\n%#v, want\n%#v", gotTmp, tt.wantTmp)
+				t.Errorf("writeEntry() got:\n%#v, want\n%#v", gotTmp, tt.wantTmp)
 			}
 		})
 	}
 }
+
+// block returns the managed block with the given entries
+func block(entries ...string) string {
+	return beginMarker + "\n" + strings.Join(entries, "") + endMarker + "\n"
+}
+
+// tempHostsFile writes a hosts file with the given content to a temporary directory, removed after the test, and
+// returns its path
+func tempHostsFile(t *testing.T, content string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "docker-etchosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_generateEtcHosts(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		ipsToNames ipsToNamesMap
+		want       string
+	}{
+		{"empty file", "", ipsToNamesMap{"1.2.3.4": {"somename"}},
+			block("1.2.3.4\tsomename\n")},
+		{"keep unmanaged lines", "127.0.0.1\tlocalhost\n", ipsToNamesMap{"1.2.3.4": {"somename"}},
+			"127.0.0.1\tlocalhost\n" + block("1.2.3.4\tsomename\n")},
+		{"update block in place", block("1.2.3.4\toldname\n", "1.2.3.5\tstale\n") + "127.0.0.1\tlocalhost\n", ipsToNamesMap{"1.2.3.4": {"newname"}},
+			block("1.2.3.4\tnewname\n") + "127.0.0.1\tlocalhost\n"},
+		{"expand wildcards", "", ipsToNamesMap{"1.2.3.4": {"app.test", "*.app.test"}},
+			block("1.2.3.4\tapp.test www.app.test api.app.test\n")},
+		{"sort entries", "", ipsToNamesMap{"fd00::1": {"d"}, "10.0.0.2": {"c"}, "9.0.0.1": {"b"}, "10.0.0.10": {"e"}},
+			block("9.0.0.1\tb\n", "10.0.0.2\tc\n", "10.0.0.10\te\n", "fd00::1\td\n")},
+		{"remove block", "127.0.0.1\tlocalhost\n" + block("1.2.3.4\tsomename\n"), ipsToNamesMap{},
+			"127.0.0.1\tlocalhost\n"},
+		{"missing end marker", "127.0.0.1\tlocalhost\n" + beginMarker + "\n1.2.3.4\tsomename\n\n# comment\n10.0.0.5\tdb\n", ipsToNamesMap{"1.2.3.4": {"newname"}},
+			"127.0.0.1\tlocalhost\n" + block("1.2.3.4\tnewname\n") + "\n# comment\n10.0.0.5\tdb\n"},
+		{"drop orphan end marker", "127.0.0.1\tlocalhost\n" + endMarker + "\n", ipsToNamesMap{"1.2.3.4": {"somename"}},
+			"127.0.0.1\tlocalhost\n" + block("1.2.3.4\tsomename\n")},
+		{"migrate legacy entries", fmt.Sprintf("127.0.0.1\tlocalhost\n%[1]s\n1.2.3.4\toldname\n# comment\n%[1]s\n1.2.3.5\tstale\n", legacyBanner), ipsToNamesMap{"1.2.3.4": {"newname"}},
+			"127.0.0.1\tlocalhost\n" + block("1.2.3.4\tnewname\n") + "# comment\n"},
+		{"keep line after lone legacy banner", fmt.Sprintf("%s\n\n# comment\n", legacyBanner), ipsToNamesMap{},
+			"\n# comment\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateEtcHosts([]byte(tt.content), tt.ipsToNames, ConfigSpec{WildcardSubdomains: []string{"www", "api"}})
+			if err != nil {
+				t.Fatalf("generateEtcHosts() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("generateEtcHosts() got:\n%#v, want\n%#v", string(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_generateEtcHosts_unmanagedConflicts(t *testing.T) {
+	content := "127.0.0.1\tlocalhost\n10.0.0.5\tdb # hand-written\n"
+	ipsToNames := ipsToNamesMap{"172.18.0.3": {"db", "db.project"}, "172.18.0.4": {"db"}}
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"skip", unmanagedConflictsSkip,
+			content + block("172.18.0.3\tdb.project\n")},
+		{"warn", unmanagedConflictsWarn,
+			content + block("172.18.0.3\tdb db.project\n", "172.18.0.4\tdb\n")},
+		{"override", unmanagedConflictsOverride,
+			"127.0.0.1\tlocalhost\n" + block("172.18.0.3\tdb db.project\n", "172.18.0.4\tdb\n") + "10.0.0.5\tdb # hand-written\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateEtcHosts([]byte(content), ipsToNames, ConfigSpec{UnmanagedConflicts: tt.policy})
+			if err != nil {
+				t.Fatalf("generateEtcHosts() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("generateEtcHosts() got:\n%#v, want\n%#v", string(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_generateEtcHosts_instances(t *testing.T) {
+	remoteBegin, remoteEnd := blockMarkers("remote")
+	remote := remoteBegin + "\n10.0.0.1\tremotename\n" + remoteEnd + "\n"
+	legacy := fmt.Sprintf("%s\n1.2.3.4\toldname\n", legacyBanner)
+	tests := []struct {
+		name       string
+		instanceID string
+		content    string
+		ipsToNames ipsToNamesMap
+		want       string
+	}{
+		{"default instance keeps other blocks", "", remote + block("1.2.3.4\toldname\n"), ipsToNamesMap{"1.2.3.4": {"newname"}},
+			remote + block("1.2.3.4\tnewname\n")},
+		{"default instance migrates legacy entries", "", remote + legacy, ipsToNamesMap{"1.2.3.4": {"newname"}},
+			remote + block("1.2.3.4\tnewname\n")},
+		{"other instance updates own block", "remote", block("1.2.3.4\tsomename\n") + remote, ipsToNamesMap{"10.0.0.2": {"newremotename"}},
+			block("1.2.3.4\tsomename\n") + remoteBegin + "\n10.0.0.2\tnewremotename\n" + remoteEnd + "\n"},
+		{"other instance ignores legacy entries", "remote", legacy, ipsToNamesMap{},
+			legacy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateEtcHosts([]byte(tt.content), tt.ipsToNames, ConfigSpec{InstanceID: tt.instanceID})
+			if err != nil {
+				t.Fatalf("generateEtcHosts() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("generateEtcHosts() got:\n%#v, want\n%#v", string(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_writeToEtcHosts_unchanged(t *testing.T) {
+	content := "127.0.0.1\tlocalhost\n" + block("1.2.3.4\tsomename\n")
+	config := ConfigSpec{EtcHostsPath: tempHostsFile(t, content)}
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(config.EtcHostsPath, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeToEtcHosts(ipsToNamesMap{"1.2.3.4": {"somename"}}, config); err != nil {
+		t.Fatalf("writeToEtcHosts() error = %v", err)
+	}
+
+	info, err := os.Stat(config.EtcHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(past) {
+		t.Errorf("writeToEtcHosts() touched unchanged file")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const labelPrefix = "net.costela.docker-etchosts."
+
+const (
+	dockerLabel    string = labelPrefix + "extra_hosts"
+	enableLabel    string = labelPrefix + "enable"
+	networkLabel   string = labelPrefix + "network"
+	hostnamesLabel string = labelPrefix + "hostnames"
+	aliasesLabel   string = labelPrefix + "aliases"
+	domainLabel    string = labelPrefix + "domain"
+	wildcardLabel  string = labelPrefix + "wildcard"
+	canonicalLabel string = labelPrefix + "canonical"
+)
+
+var hostnameRegexp = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9.-]*[a-zA-Z0-9]$")
+
+// isEnabled reports whether a container should be published, according to its enable label or, failing that, the
+// global default
+func isEnabled(labels map[string]string, config ConfigSpec) bool {
+	label, ok := labels[enableLabel]
+	if !ok {
+		return !config.OptIn
+	}
+	enabled, err := strconv.ParseBool(strings.TrimSpace(label))
+	if err != nil {
+		log.Warnf("invalid value for label %s: %s", enableLabel, label)
+		return !config.OptIn
+	}
+	return enabled
+}
+
+// isNetworkPublished reports whether a container's network should be published, according to the container's network
+// label or, failing that, the global include and exclude lists
+func isNetworkPublished(netName string, labels map[string]string, config ConfigSpec) bool {
+	if label, ok := labels[networkLabel]; ok {
+		return matchesAny(netName, strings.Split(label, ","))
+	}
+	if len(config.NetworksInclude) > 0 && !matchesAny(netName, config.NetworksInclude) {
+		return false
+	}
+	return !matchesAny(netName, config.NetworksExclude)
+}
+
+// matchesAny reports whether the name matches any of the glob patterns
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if matched, err := path.Match(pattern, name); err != nil {
+			log.Warnf("invalid network pattern %s: %s", pattern, err)
+		} else if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostnamesLabel parses a label containing either a JSON array of names, a JSON string or a comma- or
+// whitespace-separated list of names. Invalid names are skipped.
+func parseHostnamesLabel(name, label string) []string {
+	return validateHostnames(parseListLabel(name, label)...)
+}
+
+// parseListLabel parses a label containing either a JSON array, a JSON string or a comma- or whitespace-separated list
+func parseListLabel(name, label string) []string {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(label, "["):
+		var parsed []string
+		if err := json.Unmarshal([]byte(label), &parsed); err != nil {
+			log.Errorf("error parsing JSON in label %s: %s", name, err)
+		}
+		return parsed
+	case strings.HasPrefix(label, `"`):
+		var parsed string
+		if err := json.Unmarshal([]byte(label), &parsed); err != nil {
+			log.Errorf("error parsing JSON in label %s: %s", name, err)
+		}
+		return []string{parsed}
+	case strings.HasPrefix(label, "{"):
+		log.Errorf("JSON objects are not supported in label %s: %s", name, label)
+		return nil
+	default:
+		// plain lists are easier to write in compose files than JSON embedded in YAML
+		return strings.FieldsFunc(label, isListSeparator)
+	}
+}
+
+// extraHosts holds the names added via the extra_hosts label
+type extraHosts struct {
+	all        []string            // added to all networks
+	perNetwork map[string][]string // added to a single network
+	perIP      ipsToNamesMap       // added for an explicit IP, independent of the container's own
+}
+
+// parseExtraHostsLabel parses the extra_hosts label, which additionally to the formats supported by
+// parseHostnamesLabel may be a JSON object mapping network names to names, e.g. {"somenet": ["a.example.com"]}.
+// Like docker-compose's extra_hosts, names may also be mapped to explicit IPs with NAME:IP (or NAME=IP).
+func parseExtraHostsLabel(label string) extraHosts {
+	var hosts extraHosts
+
+	label = strings.TrimSpace(label)
+	if !strings.HasPrefix(label, "{") {
+		hosts.all = hosts.addExplicitIPs(parseListLabel(dockerLabel, label))
+		return hosts
+	}
+
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(label), &parsed); err != nil {
+		log.Errorf("error parsing JSON in label %s: %s", dockerLabel, err)
+		return hosts
+	}
+
+	hosts.perNetwork = make(map[string][]string, len(parsed))
+	for netName, raw := range parsed {
+		hosts.perNetwork[netName] = hosts.addExplicitIPs(parseListLabel(dockerLabel, string(raw)))
+	}
+	return hosts
+}
+
+// addExplicitIPs stores entries with explicit IPs and returns the remaining valid names
+func (h *extraHosts) addExplicitIPs(entries []string) []string {
+	var names []string
+	for _, entry := range entries {
+		sep := strings.IndexAny(entry, ":=")
+		if sep < 0 {
+			names = append(names, entry)
+			continue
+		}
+
+		ip := net.ParseIP(entry[sep+1:])
+		if ip == nil {
+			log.Warnf("skipping '%s': does not seem to be a valid IP", entry)
+			continue
+		}
+		if valid := validateHostnames(entry[:sep]); len(valid) > 0 {
+			if h.perIP == nil {
+				h.perIP = make(ipsToNamesMap)
+			}
+			h.perIP[ip.String()] = append(h.perIP[ip.String()], valid...)
+		}
+	}
+	return validateHostnames(names...)
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || unicode.IsSpace(r)
+}
+
+func validateHostnames(hosts ...string) []string {
+	var validHosts []string
+
+	for _, host := range hosts {
+		if hostnameRegexp.MatchString(host) {
+			validHosts = append(validHosts, host)
+		} else {
+			log.Warnf("skipping '%s': does not seem to be a valid hostname", host)
+		}
+	}
+
+	return validHosts
+}
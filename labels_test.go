@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_isNetworkPublished(t *testing.T) {
+	tests := []struct {
+		name    string
+		netName string
+		labels  map[string]string
+		config  ConfigSpec
+		want    bool
+	}{
+		{"no filters", "somenet", nil, ConfigSpec{}, true},
+		{"included", "somenet", nil, ConfigSpec{NetworksInclude: []string{"other", "some*"}}, true},
+		{"not included", "somenet", nil, ConfigSpec{NetworksInclude: []string{"other"}}, false},
+		{"excluded", "somenet", nil, ConfigSpec{NetworksExclude: []string{"*net"}}, false},
+		{"included and excluded", "somenet", nil, ConfigSpec{NetworksInclude: []string{"some*"}, NetworksExclude: []string{"somenet"}}, false},
+		{"picked by label", "somenet", map[string]string{networkLabel: "somenet"}, ConfigSpec{NetworksExclude: []string{"somenet"}}, true},
+		{"not picked by label", "othernet", map[string]string{networkLabel: "somenet"}, ConfigSpec{}, false},
+		{"picked by label list", "othernet", map[string]string{networkLabel: "somenet, othernet"}, ConfigSpec{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNetworkPublished(tt.netName, tt.labels, tt.config); got != tt.want {
+				t.Errorf("isNetworkPublished() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseHostnamesLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"bare name", " a.example.com ", []string{"a.example.com"}},
+		{"comma-separated list", "a.example.com,b.example.com, c.example.com", []string{"a.example.com", "b.example.com", "c.example.com"}},
+		{"whitespace-separated list", "a.example.com b.example.com\tinvalid.", []string{"a.example.com", "b.example.com"}},
+		{"JSON string", `"a.example.com"`, []string{"a.example.com"}},
+		{"JSON array", `["a.example.com", "b.example.com", "invalid."]`, []string{"a.example.com", "b.example.com"}},
+		{"invalid JSON", `["a.example.com"`, nil},
+		{"JSON object", `{"a": "b"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHostnamesLabel("somelabel", tt.label); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHostnamesLabel() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseExtraHostsLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+		want  extraHosts
+	}{
+		{"empty", "", extraHosts{}},
+		{"JSON array", `["a.example.com", "b.example.com"]`, extraHosts{all: []string{"a.example.com", "b.example.com"}}},
+		{"JSON object", `{"somenet": ["a.example.com", "invalid."], "othernet": "b.example.com"}`, extraHosts{perNetwork: map[string][]string{
+			"somenet":  {"a.example.com"},
+			"othernet": {"b.example.com"},
+		}}},
+		{"invalid JSON object", `{"somenet": }`, extraHosts{}},
+		{"explicit IPs", "a.example.com gw.example.com:10.0.0.1 host=10.0.0.1 v6.example.com:fd00::1 bad.example.com:nope invalid.:10.0.0.2", extraHosts{
+			all: []string{"a.example.com"},
+			perIP: ipsToNamesMap{
+				"10.0.0.1": {"gw.example.com", "host"},
+				"fd00::1":  {"v6.example.com"},
+			},
+		}},
+		{"explicit IPs in JSON object", `{"somenet": ["a.example.com", "gw.example.com:10.0.0.1"]}`, extraHosts{
+			perNetwork: map[string][]string{"somenet": {"a.example.com"}},
+			perIP:      ipsToNamesMap{"10.0.0.1": {"gw.example.com"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseExtraHostsLabel(tt.label); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExtraHostsLabel() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -18,24 +18,133 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
+	"path"
 	"reflect"
 	"strings"
 	"syscall"
+	"text/template"
+	"time"
+	"unicode"
 
 	docker "docker.io/go-docker"
 
-	"github.com/kelseyhightower/envconfig"
+	"github.com/pmezard/go-difflib/difflib"
 	log "github.com/sirupsen/logrus"
 )
 
 // ConfigSpec holds the runtime configuration
 type ConfigSpec struct {
-	LogLevel     string `default:"warn" split_words:"true"`
-	EtcHostsPath string `default:"/etc/hosts" split_words:"true"`
+	LogLevel              string        `default:"warn" split_words:"true" desc:"verbosity of log messages (debug, info, warn, error)"`
+	EtcHostsPath          string        `default:"/etc/hosts" split_words:"true" desc:"path to hosts file"`
+	InstanceID            string        `envconfig:"instance_id" desc:"identifier of this instance, so several instances can manage their own entries in the same hosts file"`
+	IPFamily              string        `default:"ipv4" envconfig:"ip_family" desc:"container addresses to publish (ipv4, ipv6, both)"`
+	LinkLocalIPv6         bool          `envconfig:"link_local_ipv6" desc:"also publish link-local IPv6 addresses"`
+	ResyncInterval        time.Duration `default:"5m" split_words:"true" desc:"interval between full resyncs (0 disables them)"`
+	DebounceInterval      time.Duration `default:"500ms" split_words:"true" desc:"time to wait for further events before writing (0 disables debouncing)"`
+	DebounceMaxDelay      time.Duration `default:"5s" split_words:"true" desc:"maximum time a write may be delayed by further events"`
+	Oneshot               string        `envconfig:"oneshot" desc:"run once and exit (print, diff, write)"`
+	NameTemplate          string        `split_words:"true" desc:"text/template generating the names for each container name and alias (empty for the default scheme)"`
+	Domain                string        `desc:"domain suffix appended to all generated names"`
+	KeepBareNames         bool          `split_words:"true" desc:"keep generated names without domain suffix in addition to the suffixed ones"`
+	ComposeServiceNames   bool          `default:"true" split_words:"true" desc:"use docker-compose service names (SERVICE and SERVICE-NUMBER) instead of container names"`
+	OptIn                 bool          `split_words:"true" desc:"only publish containers explicitly enabled via label"`
+	NetworksInclude       []string      `split_words:"true" desc:"comma-separated glob patterns of networks to publish (empty for all)"`
+	NetworksExclude       []string      `split_words:"true" desc:"comma-separated glob patterns of networks not to publish"`
+	HostNetworkAddress    string        `split_words:"true" desc:"IP or interface name whose address is used for containers on the host network (empty to skip them)"`
+	PublishedPorts        bool          `split_words:"true" desc:"publish containers with published ports at the host address the ports are bound to"`
+	PublishedPortsAddress string        `default:"127.0.0.1" split_words:"true" desc:"address used for ports published on all interfaces"`
+	WildcardSubdomains    []string      `split_words:"true" desc:"comma-separated subdomains written to the hosts file for wildcard names"`
+	CanonicalName         string        `default:"first" split_words:"true" desc:"which name to list first for each IP, e.g. for reverse lookups (first, shortest, longest)"`
+	NameConflicts         string        `default:"keep-all" split_words:"true" desc:"how to handle names published by several containers for different IPs (keep-all, first-wins, newest-wins, drop-ambiguous)"`
+	UnmanagedConflicts    string        `default:"skip" split_words:"true" desc:"how to handle names already set for other IPs by unmanaged hosts file entries (skip, warn, override)"`
+	Output                string        `default:"hosts" desc:"where to publish entries (hosts, dns, both)"`
+	DNSAddress            string        `default:"127.0.0.1:10053" envconfig:"dns_address" desc:"UDP address the DNS server listens on"`
+	DNSTTL                time.Duration `default:"10s" envconfig:"dns_ttl" desc:"TTL of DNS answers"`
+
+	nameTemplate *template.Template // parsed NameTemplate
+}
+
+const (
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+	ipFamilyBoth = "both"
+)
+
+// getNameTemplate returns the parsed NameTemplate, or the default one if none was configured
+func (c ConfigSpec) getNameTemplate() *template.Template {
+	if c.nameTemplate == nil {
+		return defaultParsedNameTemplate
+	}
+	return c.nameTemplate
+}
+
+// wantIPv4 reports whether IPv4 addresses should be published; an empty IPFamily defaults to IPv4
+func (c ConfigSpec) wantIPv4() bool {
+	return c.IPFamily != ipFamilyIPv6
+}
+
+// wantIPv6 reports whether global IPv6 addresses should be published
+func (c ConfigSpec) wantIPv6() bool {
+	return c.IPFamily == ipFamilyIPv6 || c.IPFamily == ipFamilyBoth
+}
+
+// wantLinkLocalIPv6 reports whether link-local IPv6 addresses should be published in addition to global ones
+func (c ConfigSpec) wantLinkLocalIPv6() bool {
+	return c.wantIPv6() && c.LinkLocalIPv6
+}
+
+// policies for picking the canonical name of each IP, unless set via label; "first" keeps the generated order
+const (
+	canonicalNameFirst    = "first"
+	canonicalNameShortest = "shortest"
+	canonicalNameLongest  = "longest"
+)
+
+// policies for names published by several containers; "first" and "newest" refer to the containers' creation time
+const (
+	nameConflictsKeepAll       = "keep-all"
+	nameConflictsFirstWins     = "first-wins"
+	nameConflictsNewestWins    = "newest-wins"
+	nameConflictsDropAmbiguous = "drop-ambiguous"
+)
+
+// policies for names already set by unmanaged hosts file entries
+const (
+	unmanagedConflictsSkip     = "skip"
+	unmanagedConflictsWarn     = "warn"
+	unmanagedConflictsOverride = "override"
+)
+
+const (
+	outputHosts = "hosts"
+	outputDNS   = "dns"
+	outputBoth  = "both"
+)
+
+// wantHostsOutput reports whether entries should be written to the hosts file; an empty Output defaults to it
+func (c ConfigSpec) wantHostsOutput() bool {
+	return c.Output != outputDNS
 }
 
+// wantDNSOutput reports whether entries should be served via DNS
+func (c ConfigSpec) wantDNSOutput() bool {
+	return c.Output == outputDNS || c.Output == outputBoth
+}
+
+// one-shot modes; the default (empty) is to keep running and listening for events
+const (
+	oneshotPrint = "print"
+	oneshotDiff  = "diff"
+	oneshotWrite = "write"
+)
+
 var logLevelMap = map[string]log.Level{
 	"debug": log.DebugLevel,
 	"info":  log.InfoLevel,
@@ -44,11 +153,17 @@ var logLevelMap = map[string]log.Level{
 }
 
 func main() {
-	var config ConfigSpec
-
-	err := envconfig.Process("etchosts", &config)
+	config, command, err := parseConfig(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Fatalf("could not parse settings from env: %s", err)
+		log.Fatal(err)
+	}
+
+	if command == cmdVersion {
+		fmt.Println(version)
+		return
 	}
 
 	logLevel, ok := logLevelMap[strings.ToLower(config.LogLevel)]
@@ -57,28 +172,176 @@ func main() {
 	}
 	log.SetLevel(logLevel)
 
-	quitSig := make(chan os.Signal)
+	if strings.IndexFunc(config.InstanceID, unicode.IsSpace) >= 0 {
+		log.Fatalf("invalid instance ID %q: must not contain whitespace", config.InstanceID)
+	}
+
+	config.IPFamily = strings.ToLower(config.IPFamily)
+	switch config.IPFamily {
+	case ipFamilyIPv4, ipFamilyIPv6, ipFamilyBoth:
+	default:
+		log.Fatalf("unknown IP family %s; valid values: %s %s %s", config.IPFamily, ipFamilyIPv4, ipFamilyIPv6, ipFamilyBoth)
+	}
+
+	config.Oneshot = strings.ToLower(config.Oneshot)
+	switch config.Oneshot {
+	case "", oneshotPrint, oneshotDiff, oneshotWrite:
+	default:
+		log.Fatalf("unknown one-shot mode %s; valid values: %s %s %s", config.Oneshot, oneshotPrint, oneshotDiff, oneshotWrite)
+	}
+
+	if config.NameTemplate != "" {
+		config.nameTemplate, err = parseNameTemplate(config.NameTemplate)
+		if err != nil {
+			log.Fatalf("could not parse name template: %s", err)
+		}
+	}
+
+	for _, pattern := range append(config.NetworksInclude, config.NetworksExclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("invalid network pattern %s: %s", pattern, err)
+		}
+	}
+
+	config.CanonicalName = strings.ToLower(config.CanonicalName)
+	switch config.CanonicalName {
+	case canonicalNameFirst, canonicalNameShortest, canonicalNameLongest:
+	default:
+		log.Fatalf("unknown canonical name policy %s; valid values: %s %s %s", config.CanonicalName, canonicalNameFirst, canonicalNameShortest, canonicalNameLongest)
+	}
+
+	config.NameConflicts = strings.ToLower(config.NameConflicts)
+	switch config.NameConflicts {
+	case nameConflictsKeepAll, nameConflictsFirstWins, nameConflictsNewestWins, nameConflictsDropAmbiguous:
+	default:
+		log.Fatalf("unknown name conflict policy %s; valid values: %s %s %s %s", config.NameConflicts, nameConflictsKeepAll, nameConflictsFirstWins, nameConflictsNewestWins, nameConflictsDropAmbiguous)
+	}
+
+	config.UnmanagedConflicts = strings.ToLower(config.UnmanagedConflicts)
+	switch config.UnmanagedConflicts {
+	case unmanagedConflictsSkip, unmanagedConflictsWarn, unmanagedConflictsOverride:
+	default:
+		log.Fatalf("unknown unmanaged conflict policy %s; valid values: %s %s %s", config.UnmanagedConflicts, unmanagedConflictsSkip, unmanagedConflictsWarn, unmanagedConflictsOverride)
+	}
+
+	config.Output = strings.ToLower(config.Output)
+	switch config.Output {
+	case outputHosts, outputDNS, outputBoth:
+	default:
+		log.Fatalf("unknown output %s; valid values: %s %s %s", config.Output, outputHosts, outputDNS, outputBoth)
+	}
+
+	if net.ParseIP(config.PublishedPortsAddress) == nil {
+		log.Fatalf("invalid published ports address %s", config.PublishedPortsAddress)
+	}
+
+	// cleaning only touches the hosts file, so it works even if docker is gone
+	if command == cmdClean {
+		if err := clean(config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		log.Fatalf("error initializing docker client: %s", err)
+	}
+	defer client.Close()
+
+	if config.Oneshot != "" {
+		if err := runOnce(client, config, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	quitSig := make(chan os.Signal, 1)
 	signal.Notify(quitSig, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		<-quitSig
 		cleanup(config)
 	}()
 
-	client, err := docker.NewEnvClient()
-	if err != nil {
-		log.Fatalf("error initializing docker client: %s", err)
+	var dns *dnsServer
+	if config.wantDNSOutput() {
+		conn, err := net.ListenPacket("udp", config.DNSAddress)
+		if err != nil {
+			log.Fatalf("could not listen for DNS queries: %s", err)
+		}
+		dns = newDNSServer(config.DNSTTL)
+		go func() {
+			log.Infof("serving DNS on %s", conn.LocalAddr())
+			log.Fatalf("error serving DNS: %s", dns.serve(conn))
+		}()
 	}
-	defer client.Close()
+	publish := newPublisher(config, dns)
 
 	for {
 		waitForConnection(client)
 		log.Info("listening for docker events")
-		syncAndListenForEvents(client, config)
+		syncAndListenForEvents(client, config, publish)
 	}
 }
 
+// newPublisher returns a function making entries available via all configured outputs
+func newPublisher(config ConfigSpec, dns *dnsServer) publishFunc {
+	return func(ipsToNames ipsToNamesMap) error {
+		if dns != nil {
+			dns.update(ipsToNames)
+		}
+		if config.wantHostsOutput() {
+			return writeToEtcHosts(ipsToNames, config)
+		}
+		return nil
+	}
+}
+
+// runOnce fetches the current entries a single time and handles them according to the configured one-shot mode
+func runOnce(client dockerClienter, config ConfigSpec, out io.Writer) error {
+	ipsToNames, err := getAllIPsToNames(client, config)
+	if err != nil {
+		return fmt.Errorf("error getting container infos: %s", err)
+	}
+
+	if config.Oneshot == oneshotWrite {
+		return writeToEtcHosts(ipsToNames, config)
+	}
+
+	oldContent, err := ioutil.ReadFile(config.EtcHostsPath)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", config.EtcHostsPath, err)
+	}
+	newContent, err := generateEtcHosts(oldContent, ipsToNames, config)
+	if err != nil {
+		return err
+	}
+
+	if config.Oneshot == oneshotDiff {
+		return difflib.WriteUnifiedDiff(out, difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(oldContent)),
+			B:        difflib.SplitLines(string(newContent)),
+			FromFile: config.EtcHostsPath,
+			ToFile:   config.EtcHostsPath + " (docker-etchosts)",
+			Context:  3,
+		})
+	}
+
+	_, err = out.Write(newContent)
+	return err
+}
+
 func cleanup(config ConfigSpec) {
-	log.Info("cleaning up hosts file")
-	writeToEtcHosts(ipsToNamesMap{}, config)
+	if config.wantHostsOutput() {
+		if err := clean(config); err != nil {
+			log.Error(err)
+		}
+	}
 	os.Exit(0)
 }
+
+// clean removes all managed entries from the hosts file
+func clean(config ConfigSpec) error {
+	log.Info("cleaning up hosts file")
+	return writeToEtcHosts(ipsToNamesMap{}, config)
+}
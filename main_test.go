@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_runOnce(t *testing.T) {
+	const original = "127.0.0.1\tlocalhost\n"
+	tests := []struct {
+		name        string
+		oneshot     string
+		wantOut     []string
+		wantWritten bool
+	}{
+		{"print", oneshotPrint, []string{original + beginMarker + "\n", "\n1.2.3.4\tservice1 somealias\n", endMarker + "\n"}, false},
+		{"diff", oneshotDiff, []string{"--- ", "+++ ", " 127.0.0.1\tlocalhost\n", "+" + beginMarker + "\n", "+1.2.3.4\tservice1 somealias\n", "+" + endMarker + "\n"}, false},
+		{"write", oneshotWrite, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := ConfigSpec{EtcHostsPath: tempHostsFile(t, original), Oneshot: tt.oneshot}
+
+			out := &bytes.Buffer{}
+			if err := runOnce(testClient{}, config, out); err != nil {
+				t.Fatalf("runOnce() error = %v", err)
+			}
+
+			for _, want := range tt.wantOut {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("runOnce() output missing %#v, got:\n%s", want, out)
+				}
+			}
+			if tt.wantOut == nil && out.Len() != 0 {
+				t.Errorf("runOnce() unexpected output:\n%s", out)
+			}
+
+			content, err := ioutil.ReadFile(config.EtcHostsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written := string(content) != original; written != tt.wantWritten {
+				t.Errorf("runOnce() wrote hosts file: %t, want %t", written, tt.wantWritten)
+			}
+		})
+	}
+}
+
+func Test_clean(t *testing.T) {
+	const original = "127.0.0.1\tlocalhost\n"
+	config := ConfigSpec{EtcHostsPath: tempHostsFile(t, original+block("1.2.3.4\tsomename\n"))}
+
+	if err := clean(config); err != nil {
+		t.Fatalf("clean() error = %v", err)
+	}
+
+	content, err := ioutil.ReadFile(config.EtcHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != original {
+		t.Errorf("clean() left:\n%s", content)
+	}
+}